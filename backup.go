@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// restoreBatchSize is how many books a JSON import inserts per transaction.
+const restoreBatchSize = 100
+
+// exportBatchSize is how many books the JSON export reads per query.
+const exportBatchSize = 100
+
+// maxRestoreBytes caps a JSON import body. It is far above maxBodyBytes
+// since the body is decoded one book at a time rather than all at once.
+const maxRestoreBytes = 1 << 30
+
+// restoreTimeout bounds a whole JSON import.
+const restoreTimeout = 10 * time.Minute
+
+// restoreRecordError describes why one element of an import was skipped.
+// Index counts the array's elements from 0.
+type restoreRecordError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// restoreResult is the summary handlerBooksImportJSON responds with.
+type restoreResult struct {
+	Imported int                  `json:"imported"`
+	Failed   int                  `json:"failed"`
+	Errors   []restoreRecordError `json:"errors"`
+}
+
+// handlerBooksExportJSON streams every book matching the list filters as a
+// JSON array, in id order and with its tags, for backups. Books are read
+// exportBatchSize at a time, paging on id, and each page is written before
+// the next is read, so memory use doesn't grow with the catalog. Paging
+// rather than holding one cursor open leaves the connection free for the
+// page's tags query.
+func (s *Server) handlerBooksExportJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	filter, err := s.parseBookFilter(r)
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+	books, err := s.exportBatch(ctx, filter)
+	if err != nil {
+		writeDBError(w, err, "could not export books")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="books.json"`)
+	_, err = io.WriteString(w, "[")
+	enc := json.NewEncoder(w)
+	for n := 0; err == nil && len(books) > 0; {
+		for _, book := range books {
+			if n > 0 {
+				_, err = io.WriteString(w, ",")
+				if err != nil {
+					break
+				}
+			}
+			err = enc.Encode(book)
+			if err != nil {
+				break
+			}
+			n++
+		}
+		if err != nil || len(books) < exportBatchSize {
+			break
+		}
+		filter.AfterID = int(books[len(books)-1].ID)
+		books, err = s.exportBatch(ctx, filter)
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "]\n")
+	}
+	if err != nil {
+		// as with the CSV export, the client is left with a truncated
+		// array that won't parse, which is the best signal left to send
+		logCtx(ctx, err)
+	}
+}
+
+// exportBatch returns the first exportBatchSize books matching filter in id
+// order, with their tags.
+func (s *Server) exportBatch(ctx context.Context, filter bookFilter) ([]Book, error) {
+	where, args := filter.where()
+	var books []Book
+	err := s.retryDB(ctx, func() error {
+		var err error
+		books, err = s.queryBooks(ctx, `SELECT `+bookColumns+` FROM books`+where+` ORDER BY id LIMIT ?`,
+			append(args, exportBatchSize)...)
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	ids := make([]int, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, int(book.ID))
+	}
+	tags, err := s.tagsOfBooks(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range books {
+		books[i].Tags = tags[int(books[i].ID)]
+	}
+	return books, nil
+}
+
+// handlerBooksImportJSON creates books from a JSON array such as the JSON
+// export writes, tags included; the server-assigned fields in it are
+// ignored. The array is
+// decoded one element at a time and inserted in batches of
+// restoreBatchSize, so a large backup never sits in memory whole. Elements
+// that fail to decode or validate are reported and skipped. Batches already
+// committed stay written even if a later part of the body turns out to be
+// malformed.
+func (s *Server) handlerBooksImportJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "POST")
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), restoreTimeout)
+	defer cancel()
+	r.Body = http.MaxBytesReader(w, r.Body, maxRestoreBytes)
+	dec := json.NewDecoder(r.Body)
+	tok, err := dec.Token()
+	if err == io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "JSON body is empty")
+		return
+	} else if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		writeJSONError(w, http.StatusBadRequest, "JSON body must be an array of books")
+		return
+	}
+	result := restoreResult{Errors: make([]restoreRecordError, 0)}
+	batch := make([]Book, 0, restoreBatchSize)
+	indexes := make([]int, 0, restoreBatchSize)
+	dbFailed := func(err error) {
+		writeDBError(w, err, fmt.Sprintf("could not import books; %d were imported before the failure", result.Imported))
+	}
+	flush := func() error {
+		err := s.restoreBatch(ctx, batch, indexes, &result)
+		batch, indexes = batch[:0], indexes[:0]
+		return err
+	}
+	// abort keeps the books decoded before a body that stopped being
+	// readable at element index, or after the last one when index is -1
+	abort := func(err error, index int) {
+		logCtx(ctx, err)
+		flushErr := flush()
+		if flushErr != nil {
+			dbFailed(flushErr)
+			return
+		}
+		writeRestoreError(w, err, index, result.Imported)
+	}
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err != nil {
+			// a syntax error leaves the decoder lost, so nothing after
+			// it can be read
+			abort(err, i)
+			return
+		}
+		book, err := decodeBook(raw)
+		if err == nil {
+			err = validateBookPayload(raw, book)
+		}
+		if err == nil {
+			book.Tags, err = normalizeTags(book.Tags)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, restoreRecordError{Index: i, Error: strings.TrimPrefix(err.Error(), "json: ")})
+			continue
+		}
+		batch = append(batch, book)
+		indexes = append(indexes, i)
+		if len(batch) == restoreBatchSize {
+			err := flush()
+			if err != nil {
+				dbFailed(err)
+				return
+			}
+		}
+	}
+	_, err = dec.Token()
+	if err != nil {
+		abort(err, -1)
+		return
+	}
+	err = flush()
+	if err != nil {
+		dbFailed(err)
+		return
+	}
+	// duplicates are only found when their batch is inserted, after the
+	// batch's later elements were checked
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Index < result.Errors[j].Index })
+	result.Failed = len(result.Errors)
+	writeJSON(w, http.StatusOK, result, prettyJSON(r))
+}
+
+// restoreBatch inserts batch, whose elements came from the given array
+// indexes, and adds the outcome to result. A duplicate ISBN fails the whole
+// transaction, so the batch is then inserted one book at a time to find and
+// report the books that clash while keeping the rest.
+func (s *Server) restoreBatch(ctx context.Context, batch []Book, indexes []int, result *restoreResult) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	ids, err := s.restoreBooks(ctx, batch)
+	if err == nil {
+		result.Imported += len(ids)
+		s.booksChanged(eventCreated, ids...)
+		return nil
+	}
+	if !errors.Is(err, errDuplicateISBN) {
+		return err
+	}
+	for i, book := range batch {
+		ids, err := s.restoreBooks(ctx, []Book{book})
+		if errors.Is(err, errDuplicateISBN) {
+			result.Errors = append(result.Errors, restoreRecordError{Index: indexes[i], Error: err.Error()})
+			continue
+		} else if err != nil {
+			return err
+		}
+		result.Imported++
+		s.booksChanged(eventCreated, ids...)
+	}
+	return nil
+}
+
+// restoreBooks is insertBooks for an import: each book's tags, already
+// normalized, are attached in the same transaction.
+func (s *Server) restoreBooks(ctx context.Context, books []Book) ([]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	ids := make([]int, 0, len(books))
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		ids = ids[:0]
+		for _, book := range books {
+			id, err := s.execInsertBook(ctx, tx, book)
+			if err != nil {
+				return err
+			}
+			err = insertBookTags(ctx, tx, id, book.Tags)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+// writeRestoreError responds to a JSON import body that could not be read
+// at element index, or after the last element when index is -1, saying how
+// many books were imported before it.
+func writeRestoreError(w http.ResponseWriter, err error, index, imported int) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes; %d books were imported before the limit", tooLarge.Limit, imported))
+		return
+	}
+	where := "after the last element"
+	if index >= 0 {
+		where = fmt.Sprintf("at element %d", index)
+	}
+	writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON %s; %d books were imported before it", where, imported))
+}
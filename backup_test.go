@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestJSONBackupRoundTrip exports a catalog spanning several export
+// batches and imports it into an empty server, tags included.
+func TestJSONBackupRoundTrip(t *testing.T) {
+	src := newSQLiteServer(t)
+	ctx := context.Background()
+	books := make([]Book, exportBatchSize*2+5)
+	for i := range books {
+		books[i] = Book{Title: fmt.Sprintf("Book %d", i), Author: "Author"}
+	}
+	ids, err := src.insertBooks(ctx, books)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged := map[int][]string{
+		ids[0]:                   {"classic", "sci-fi"},
+		ids[exportBatchSize]:     {"classic"},
+		ids[len(ids)-1]:          {"to-read"},
+		ids[exportBatchSize*2-1]: {"sci-fi"},
+	}
+	for id, tags := range tagged {
+		for _, tag := range tags {
+			_, err := src.addBookTag(ctx, id, tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	w := serve(src.SetupRoutes(http.NewServeMux()), http.MethodGet, "/api/books/export/json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status = %d; body %s", w.Code, w.Body)
+	}
+	var exported []Book
+	if err := json.Unmarshal(w.Body.Bytes(), &exported); err != nil {
+		t.Fatalf("export is not a JSON array: %v", err)
+	}
+	if len(exported) != len(books) {
+		t.Fatalf("exported %d books, want %d", len(exported), len(books))
+	}
+
+	dst := newSQLiteServer(t)
+	w = serve(dst.SetupRoutes(http.NewServeMux()), http.MethodPost, "/api/books/import/json", w.Body.String())
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: status = %d; body %s", w.Code, w.Body)
+	}
+	var result restoreResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != len(books) || result.Failed != 0 {
+		t.Fatalf("import result = %+v, want all %d imported", result, len(books))
+	}
+	for id, want := range tagged {
+		// both databases start empty, so the ids line up
+		got, err := dst.bookTags(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("book %d tags = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestImportJSONTags(t *testing.T) {
+	s := newSQLiteServer(t)
+	h := s.SetupRoutes(http.NewServeMux())
+	w := serve(h, http.MethodPost, "/api/books/import/json", `[
+		{"title": "Dune", "author": "Frank Herbert", "tags": [" Sci-Fi", "sci-fi", "Classic"]},
+		{"title": "Emma", "author": "Jane Austen", "tags": ["a/b"]}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; body %s", w.Code, w.Body)
+	}
+	var result restoreResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 1 || len(result.Errors) != 1 || result.Errors[0].Index != 1 || result.Errors[0].Error != "tags: must not contain /" {
+		t.Errorf("result = %+v, want Dune imported and Emma refused for its tag", result)
+	}
+	tags, err := s.bookTags(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(tags) != "[classic sci-fi]" {
+		t.Errorf("tags = %v, want [classic sci-fi]", tags)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// BookID is a book's id. It is always written as a JSON number, but a
+// numeric string such as "5" is read as well, since some loosely typed
+// clients send ids that way.
+type BookID int
+
+var errInvalidID = errors.New("id must be an integer or a string of digits")
+
+func (id *BookID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var n int
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return errInvalidID
+		}
+		n, err = strconv.Atoi(s)
+		if err != nil {
+			return errInvalidID
+		}
+	} else if json.Unmarshal(data, &n) != nil {
+		return errInvalidID
+	}
+	*id = BookID(n)
+	return nil
+}
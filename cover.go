@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxCoverBytes caps an uploaded cover image. It fits MySQL's MEDIUMBLOB.
+const maxCoverBytes = 5 << 20
+
+// coverTypes are the image types a cover may be.
+var coverTypes = map[string]bool{"image/jpeg": true, "image/png": true}
+
+// coverFormField is the multipart form field an upload carries the image in.
+const coverFormField = "cover"
+
+var errUnsupportedCover = errors.New("cover must be a JPEG or PNG image")
+
+// createCoversTable creates the table holding one cover image per book.
+func (s *Server) createCoversTable(ctx context.Context) error {
+	blob := "MEDIUMBLOB"
+	if s.driver == driverSQLite {
+		blob = "BLOB"
+	}
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS covers (
+	book_id INT NOT NULL PRIMARY KEY,
+	content_type VARCHAR(32) NOT NULL,
+	data `+blob+` NOT NULL,
+	updated_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// getCover returns the cover of bookID and its content type. It returns
+// errBookNotFound if the book doesn't exist, has been deleted or has no
+// cover.
+func (s *Server) getCover(ctx context.Context, bookID int) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var data []byte
+	var contentType string
+	err := s.retryDB(ctx, func() error {
+		return s.db.QueryRowContext(ctx, `SELECT c.content_type, c.data FROM covers c
+	JOIN books b ON b.id = c.book_id
+	WHERE c.book_id = ? AND b.deleted_at IS NULL`, bookID).Scan(&contentType, &data)
+	})
+	if err == sql.ErrNoRows {
+		return nil, "", errBookNotFound
+	} else if err != nil {
+		logCtx(ctx, err)
+		return nil, "", err
+	}
+	return data, contentType, nil
+}
+
+// putCover stores data as the cover of bookID, replacing any earlier one.
+// It returns errBookNotFound if the book doesn't exist or has been deleted.
+func (s *Server) putCover(ctx context.Context, bookID int, contentType string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	query := `INSERT INTO covers (book_id, content_type, data, updated_at) VALUES (?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE content_type = VALUES(content_type), data = VALUES(data), updated_at = VALUES(updated_at)`
+	if s.driver == driverSQLite {
+		query = `INSERT INTO covers (book_id, content_type, data, updated_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT(book_id) DO UPDATE SET content_type = excluded.content_type, data = excluded.data, updated_at = excluded.updated_at`
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		live, err := bookIsLive(ctx, tx, bookID)
+		if err != nil {
+			return err
+		}
+		if !live {
+			return errBookNotFound
+		}
+		_, err = tx.ExecContext(ctx, query, bookID, contentType, data, time.Now().UTC())
+		return err
+	})
+	if err != nil && err != errBookNotFound {
+		logCtx(ctx, err)
+	}
+	return err
+}
+
+// readCover reads the image of a cover upload, either the raw request body
+// or the cover field of a multipart form. The declared type must be JPEG or
+// PNG and the bytes must actually be one.
+func readCover(r *http.Request) ([]byte, string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", errUnsupportedCover
+	}
+	body := io.Reader(r.Body)
+	if mediaType == "multipart/form-data" {
+		file, header, err := r.FormFile(coverFormField)
+		if err != nil {
+			return nil, "", err
+		}
+		defer file.Close()
+		mediaType, _, err = mime.ParseMediaType(header.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, "", errUnsupportedCover
+		}
+		body = file
+	}
+	if !coverTypes[mediaType] {
+		return nil, "", errUnsupportedCover
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	// don't trust the header alone, so a stray file can't be served back
+	// as an image
+	if http.DetectContentType(data) != mediaType {
+		return nil, "", errUnsupportedCover
+	}
+	return data, mediaType, nil
+}
+
+// handlerBookCover serves (GET) or replaces (PUT) the cover image of a book.
+func (s *Server) handlerBookCover(w http.ResponseWriter, r *http.Request, bookID int) {
+	switch r.Method {
+	case http.MethodGet:
+		data, contentType, err := s.getCover(r.Context(), bookID)
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "cover not found")
+			return
+		} else if err != nil {
+			writeDBError(w, err, "could not fetch cover")
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, err = w.Write(data)
+		if err != nil {
+			logCtx(r.Context(), err)
+		}
+	case http.MethodPut:
+		// leave room for the multipart framing around the image
+		r.Body = http.MaxBytesReader(w, r.Body, maxCoverBytes+64<<10)
+		data, contentType, err := readCover(r)
+		if err == errUnsupportedCover {
+			writeJSONError(w, http.StatusUnsupportedMediaType, err.Error())
+			return
+		} else if errors.Is(err, http.ErrMissingFile) {
+			writeJSONError(w, http.StatusBadRequest, "multipart upload must include a "+coverFormField+" file")
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || len(data) > maxCoverBytes {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("cover must be at most %d bytes", maxCoverBytes))
+			return
+		} else if err != nil {
+			logCtx(r.Context(), err)
+			writeJSONError(w, http.StatusBadRequest, "could not read cover upload")
+			return
+		}
+		err = s.putCover(r.Context(), bookID, contentType, data)
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		} else if err != nil {
+			writeDBError(w, err, "could not store cover")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodOptions:
+		writePreflight(w, "GET, PUT, OPTIONS")
+	default:
+		writeMethodNotAllowed(w, "GET, PUT, OPTIONS")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns are the header names an import may use. title and author are
+// required; the order in the file doesn't matter.
+var csvColumns = map[string]bool{"title": true, "author": true, "isbn": true, "year": true, "genre": true, "price": true}
+
+// csvReadOnlyColumns appear in exports but are assigned by the server, so an
+// import accepts and ignores them. This lets an export be imported again.
+var csvReadOnlyColumns = map[string]bool{"id": true, "version": true, "created_at": true, "updated_at": true}
+
+// csvExportHeader is the header row of an export.
+var csvExportHeader = []string{"id", "title", "author", "isbn", "year", "genre", "price", "version", "created_at", "updated_at"}
+
+// exportTimeout bounds a whole export, which streams for far longer than a
+// normal query is allowed to take.
+const exportTimeout = 5 * time.Minute
+
+// csvRowError describes why one line of an import was skipped. Row is the
+// line number in the file, counting the header as line 1.
+type csvRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// csvImportResult is the summary handlerBooksImport responds with.
+type csvImportResult struct {
+	Imported int           `json:"imported"`
+	Errors   []csvRowError `json:"errors"`
+}
+
+// parseCSVHeader maps each known column name to its index in the header.
+func parseCSVHeader(header []string) (map[string]int, error) {
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		// spreadsheet exports often start with a UTF-8 byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if csvReadOnlyColumns[name] {
+			continue
+		}
+		if !csvColumns[name] {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		if _, dup := index[name]; dup {
+			return nil, fmt.Errorf("duplicate CSV column %q", name)
+		}
+		index[name] = i
+	}
+	for _, name := range []string{"title", "author"} {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("CSV header must include %q", name)
+		}
+	}
+	return index, nil
+}
+
+// bookFromCSV builds a book from one record using the header index.
+func bookFromCSV(record []string, index map[string]int) (Book, error) {
+	field := func(name string) string {
+		if i, ok := index[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	book := Book{
+		Title:  field("title"),
+		Author: field("author"),
+		ISBN:   field("isbn"),
+		Genre:  field("genre"),
+	}
+	if v := field("year"); v != "" {
+		year, err := strconv.Atoi(v)
+		if err != nil {
+			return Book{}, fieldErrors{"year": "must be an integer"}
+		}
+		book.Year = year
+	}
+	if v := field("price"); v != "" {
+		price, err := parsePrice(v)
+		if err != nil {
+			return Book{}, fieldErrors{"price": err.Error()}
+		}
+		book.PriceCents = price
+	}
+	return book, validateBook(book)
+}
+
+// handlerBooksImport creates books from a CSV upload. Rows that fail
+// validation are reported and skipped; the rest go in one transaction.
+func (s *Server) handlerBooksImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "POST")
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/csv" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be text/csv")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	reader := csv.NewReader(r.Body)
+	reader.TrimLeadingSpace = true
+	// a short or long row is reported like any other bad row rather than
+	// aborting the whole import
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "CSV body is empty")
+		return
+	} else if err != nil {
+		logCtx(r.Context(), err)
+		writeCSVError(w, err)
+		return
+	}
+	index, err := parseCSVHeader(header)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	result := csvImportResult{Errors: make([]csvRowError, 0)}
+	var books []Book
+	for rows := 0; ; rows++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logCtx(r.Context(), err)
+			writeCSVError(w, err)
+			return
+		}
+		if rows == maxBatchSize {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("at most %d books can be imported at once", maxBatchSize))
+			return
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			result.Errors = append(result.Errors, csvRowError{Row: line, Error: fmt.Sprintf("expected %d fields, got %d", len(header), len(record))})
+			continue
+		}
+		book, err := bookFromCSV(record, index)
+		if err != nil {
+			result.Errors = append(result.Errors, csvRowError{Row: line, Error: err.Error()})
+			continue
+		}
+		books = append(books, book)
+	}
+	if len(books) > 0 {
+		ids, err := s.insertBooks(r.Context(), books)
+		if err == errDuplicateISBN {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			logCtx(r.Context(), err)
+			writeDBError(w, err, "could not import books")
+			return
+		}
+		s.booksChanged(eventCreated, ids...)
+	}
+	result.Imported = len(books)
+	writeJSON(w, http.StatusOK, result, prettyJSON(r))
+}
+
+// writeCSVError responds to a failure reading a CSV body, naming the line
+// for malformed CSV.
+func writeCSVError(w http.ResponseWriter, err error) {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid CSV on line %d: %v", parseErr.Line, parseErr.Err))
+		return
+	}
+	writeDecodeError(w, err)
+}
+
+// csvRecord renders book in the csvExportHeader column order.
+func csvRecord(book Book) []string {
+	year, price := "", ""
+	if book.Year != 0 {
+		year = strconv.Itoa(book.Year)
+	}
+	if book.PriceCents != 0 {
+		price = book.PriceCents.String()
+	}
+	return []string{
+		strconv.Itoa(int(book.ID)),
+		book.Title,
+		book.Author,
+		book.ISBN,
+		year,
+		book.Genre,
+		price,
+		strconv.Itoa(book.Version),
+		book.CreatedAt.UTC().Format(time.RFC3339),
+		book.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// exportRows queries every book matching filter in id order, for an export
+// to stream from.
+func (s *Server) exportRows(ctx context.Context, filter bookFilter) (*sql.Rows, error) {
+	where, args := filter.where()
+	return s.db.QueryContext(ctx, `SELECT `+bookColumns+` FROM books`+where+` ORDER BY id`, args...)
+}
+
+// handlerBooksExport streams every book matching the list filters as CSV,
+// in id order. Rows are written as they are read, so memory use doesn't
+// grow with the catalog.
+func (s *Server) handlerBooksExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	filter, err := s.parseBookFilter(r)
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+	results, err := s.exportRows(ctx, filter)
+	if err != nil {
+		logCtx(ctx, err)
+		writeDBError(w, err, "could not export books")
+		return
+	}
+	defer results.Close()
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="books.csv"`)
+	writer := csv.NewWriter(w)
+	writer.Write(csvExportHeader)
+	for results.Next() {
+		var book Book
+		err = scanBook(results, &book)
+		if err != nil {
+			break
+		}
+		err = writer.Write(csvRecord(book))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = results.Err()
+	}
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		// the 200 and part of the file are already sent, so all that's
+		// left is to stop and log; the client sees a truncated download
+		logCtx(ctx, err)
+	}
+}
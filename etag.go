@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bookETag derives a strong entity tag from every stored field of book and
+// its tags, so it changes whenever the book's JSON representation would.
+func bookETag(book *Book) string {
+	h := sha256.New()
+	deletedAt := ""
+	if book.DeletedAt != nil {
+		deletedAt = book.DeletedAt.UTC().Format(time.RFC3339Nano)
+	}
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%s\x00%d\x00%s\x00%d\x00%d\x00%s\x00%s\x00%s\x00%s",
+		book.ID, book.Title, book.Author, book.ISBN, book.Year, book.Genre, book.PriceCents, book.Version,
+		book.CreatedAt.UTC().Format(time.RFC3339Nano), book.UpdatedAt.UTC().Format(time.RFC3339Nano),
+		deletedAt, strings.Join(book.Tags, "\x00"))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// ratedBookETag is bookETag for a response that also carries rating.
+func ratedBookETag(book *Book, rating bookRating) string {
+	h := sha256.New()
+	average := "null"
+	if rating.AverageRating != nil {
+		average = fmt.Sprint(*rating.AverageRating)
+	}
+	fmt.Fprintf(h, "%s\x00%s\x00%d", bookETag(book), average, rating.ReviewCount)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// xmlETag derives the tag of a book's XML representation from etag, the
+// tag of its JSON one. The two bodies differ, so they mustn't share a
+// strong tag.
+func xmlETag(etag string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00application/xml", etag)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// negotiatedETag returns etag, or its xmlETag when r is answered in XML.
+func negotiatedETag(r *http.Request, etag string) string {
+	if prefersXML(r) {
+		return xmlETag(etag)
+	}
+	return etag
+}
+
+// etagMatchesNone reports whether an If-None-Match header value matches
+// etag. It uses the weak comparison RFC 9110 prescribes for If-None-Match.
+func etagMatchesNone(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether an If-Match header value matches etag, the
+// tag of a book that exists. It uses the strong comparison RFC 9110
+// prescribes for If-Match, so a weak tag never matches.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (!strings.HasPrefix(candidate, "W/") && candidate == etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesBookETag reports whether an If-Match header value matches etag,
+// the JSON tag of a book, or the XML tag derived from it. Both name the
+// same stored state.
+func matchesBookETag(header, etag string) bool {
+	return etagMatches(header, etag) || etagMatches(header, xmlETag(etag))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestETagPerMediaType(t *testing.T) {
+	s := newSQLiteServer(t)
+	h := s.SetupRoutes(http.NewServeMux())
+	_, err := s.insertBook(context.Background(), Book{Title: "Dune", Author: "Frank Herbert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/books/1", nil)
+		r.Header.Set("Accept", accept)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	jsonTag := get("application/json", "").Header().Get("ETag")
+	xmlTag := get("application/xml", "").Header().Get("ETag")
+	if jsonTag == "" || jsonTag == xmlTag {
+		t.Fatalf("ETags = %q (JSON), %q (XML), want two different tags", jsonTag, xmlTag)
+	}
+
+	tests := []struct {
+		name        string
+		accept      string
+		ifNoneMatch string
+		status      int
+	}{
+		{"JSON, own tag", "application/json", jsonTag, http.StatusNotModified},
+		{"XML, own tag", "application/xml", xmlTag, http.StatusNotModified},
+		{"XML, JSON tag", "application/xml", jsonTag, http.StatusOK},
+		{"JSON, XML tag", "application/json", xmlTag, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := get(tt.accept, tt.ifNoneMatch); w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+
+	// either tag names the stored book, so either may guard a PUT
+	put := func(ifMatch, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/api/books/1", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := put(xmlTag, `{"title": "Dune", "author": "Frank Herbert", "year": 1965}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT with the XML tag: status = %d, want %d; body %s", w.Code, http.StatusOK, w.Body)
+	}
+	newTag := w.Header().Get("ETag")
+	if w := put(jsonTag, `{"title": "Dune", "author": "Frank Herbert", "year": 1966}`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a stale tag: status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if w := put(newTag, `{"title": "Dune", "author": "Frank Herbert", "year": 1966}`); w.Code != http.StatusOK {
+		t.Errorf("PUT with the JSON tag: status = %d, want %d; body %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestIfMatchRatedETag(t *testing.T) {
+	s := newSQLiteServer(t)
+	h := s.SetupRoutes(http.NewServeMux())
+	ctx := context.Background()
+	_, err := s.insertBook(ctx, Book{Title: "Dune", Author: "Frank Herbert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratedTag := func(accept string) string {
+		r := httptest.NewRequest(http.MethodGet, "/api/books/1?include=rating", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET ?include=rating: status = %d; body %s", w.Code, w.Body)
+		}
+		return w.Header().Get("ETag")
+	}
+	put := func(ifMatch string) int {
+		r := httptest.NewRequest(http.MethodPut, "/api/books/1", strings.NewReader(`{"title": "Dune", "author": "Frank Herbert"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		accept string
+	}{
+		{"JSON", "application/json"},
+		{"XML", "application/xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := put(ratedTag(tt.accept)); got != http.StatusOK {
+				t.Errorf("PUT with the rated tag: status = %d, want %d", got, http.StatusOK)
+			}
+		})
+	}
+
+	// a new review changes what ?include=rating shows, so its old tag is stale
+	tag := ratedTag("application/json")
+	_, err = s.insertReview(ctx, Review{BookID: 1, Rating: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := put(tag); got != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a rated tag from before a review: status = %d, want %d", got, http.StatusPreconditionFailed)
+	}
+}
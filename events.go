@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The kinds of bookEvent.
+const (
+	eventCreated  = "created"
+	eventUpdated  = "updated"
+	eventDeleted  = "deleted"
+	eventRestored = "restored"
+)
+
+// eventsKeepAlive is how often an idle event stream gets a comment line,
+// so proxies and load balancers don't close it as dead.
+const eventsKeepAlive = 15 * time.Second
+
+// eventBuffer is how many events a subscriber may fall behind by before it
+// is disconnected.
+const eventBuffer = 64
+
+// maxEventSubscribers caps the open event streams.
+const maxEventSubscribers = 100
+
+// bookEvent is one change to the catalog, sent as a server-sent event whose
+// event name is Type.
+type bookEvent struct {
+	Type string `json:"-"`
+	ID   int    `json:"id"`
+}
+
+// eventHub fans events out to the open event streams.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers []chan bookEvent
+	closed      bool
+}
+
+// subscribe returns a channel that receives every event published from now
+// on, or nil if the hub is full or shutting down. The channel is closed
+// when the subscriber falls too far behind or the hub closes.
+func (h *eventHub) subscribe() chan bookEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed || len(h.subscribers) >= maxEventSubscribers {
+		return nil
+	}
+	ch := make(chan bookEvent, eventBuffer)
+	h.subscribers = append(h.subscribers, ch)
+	return ch
+}
+
+// unsubscribe removes ch and closes it, unless publish already has.
+func (h *eventHub) unsubscribe(ch chan bookEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, sub := range h.subscribers {
+		if sub == ch {
+			h.subscribers = append(h.subscribers[:i], h.subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// publish sends e to every subscriber without blocking. A subscriber whose
+// buffer is full is dropped rather than holding up the write that
+// published; its stream ends and the client can reconnect.
+func (h *eventHub) publish(e bookEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	kept := h.subscribers[:0]
+	for _, ch := range h.subscribers {
+		select {
+		case ch <- e:
+			kept = append(kept, ch)
+		default:
+			close(ch)
+		}
+	}
+	h.subscribers = kept
+}
+
+// publishBooks publishes an event of kind for each of ids.
+func (h *eventHub) publishBooks(kind string, ids ...int) {
+	for _, id := range ids {
+		h.publish(bookEvent{Type: kind, ID: id})
+	}
+}
+
+// close ends every stream and refuses new ones, so a graceful shutdown
+// doesn't wait on clients that never hang up.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, ch := range h.subscribers {
+		close(ch)
+	}
+	h.subscribers = nil
+}
+
+// booksChanged records a successful write to ids: the cached list pages
+// are dropped and an event of kind is published for each id.
+func (s *Server) booksChanged(kind string, ids ...int) {
+	s.listCache.invalidate()
+	s.events.publishBooks(kind, ids...)
+}
+
+// handlerBooksEvents streams catalog changes as server-sent events until the
+// client disconnects.
+func (s *Server) handlerBooksEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	ch := s.events.subscribe()
+	if ch == nil {
+		w.Header().Set("Retry-After", "5")
+		writeJSONError(w, http.StatusServiceUnavailable, "too many event streams open, try again later")
+		return
+	}
+	defer s.events.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	err := rc.Flush()
+	if err != nil {
+		logCtx(r.Context(), err)
+		return
+	}
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for seq := 1; ; {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logCtx(r.Context(), err)
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, e.Type, data)
+			if err != nil {
+				return
+			}
+			seq++
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		}
+		err := rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// idempotencyKeyTTL is how long a POST's Idempotency-Key is remembered. A
+// retry after that creates a new book.
+const idempotencyKeyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength matches the idem_key column.
+const maxIdempotencyKeyLength = 255
+
+// errIdempotencyKeyRace means another request stored the same key between
+// our lookup and our insert.
+var errIdempotencyKeyRace = errors.New("idempotency key was stored concurrently")
+
+// createIdempotencyTable creates the table mapping Idempotency-Key values to
+// the book each one created. The SQL is valid for both MySQL and SQLite.
+func (s *Server) createIdempotencyTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS idempotency_keys (
+	idem_key VARCHAR(255) NOT NULL PRIMARY KEY,
+	book_id INT NOT NULL,
+	created_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// lookupIdempotencyKey returns the id of the book created under key, or 0 if
+// the key is unknown or has expired.
+func (s *Server) lookupIdempotencyKey(ctx context.Context, key string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var bookID int
+	err := s.retryDB(ctx, func() error {
+		return s.db.QueryRowContext(ctx, `SELECT book_id FROM idempotency_keys WHERE idem_key = ? AND created_at > ?`,
+			key, time.Now().UTC().Add(-idempotencyKeyTTL)).Scan(&bookID)
+	})
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return bookID, nil
+}
+
+// insertBookIdempotent stores book and, when key is set, records key against
+// the new id in the same transaction. Expired keys are purged first so they
+// can be reused. It returns errIdempotencyKeyRace if the key already exists.
+func (s *Server) insertBookIdempotent(ctx context.Context, book Book, key string) (int, error) {
+	if key == "" {
+		return s.insertBook(ctx, book)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var id int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		_, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at <= ?`, now.Add(-idempotencyKeyTTL))
+		if err != nil {
+			return err
+		}
+		id, err = s.execInsertBook(ctx, tx, book)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO idempotency_keys (idem_key, book_id, created_at) VALUES (?, ?, ?)`,
+			key, id, now)
+		if isUniqueViolation(err) {
+			return errIdempotencyKeyRace
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
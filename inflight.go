@@ -0,0 +1,28 @@
+package main
+
+import "net/http"
+
+// inflight is a semaphore with one slot per request allowed to run at once;
+// nil means no limit.
+var inflight chan struct{}
+
+// inflightMiddleware sheds requests with 503 once MAX_INFLIGHT of them are
+// already running, so a spike backs off at the door instead of queuing on
+// the database pool.
+func inflightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inflight == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case inflight <- struct{}{}:
+			defer func() { <-inflight }()
+			next.ServeHTTP(w, r)
+		default:
+			logger.WarnContext(r.Context(), "shedding request, too many in flight", "max_inflight", cap(inflight))
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, http.StatusServiceUnavailable, "server is busy, try again later")
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import "strings"
+
+// normalizeISBN strips the hyphens and spaces ISBNs are usually printed
+// with and upper-cases a trailing ISBN-10 check character.
+func normalizeISBN(isbn string) string {
+	isbn = strings.NewReplacer("-", "", " ", "").Replace(isbn)
+	return strings.ToUpper(isbn)
+}
+
+// nullableISBN returns the normalized isbn for storage, or nil when it is
+// empty so that books without an ISBN don't collide on the unique index.
+func nullableISBN(isbn string) interface{} {
+	isbn = normalizeISBN(isbn)
+	if isbn == "" {
+		return nil
+	}
+	return isbn
+}
+
+// validISBN reports whether isbn, already normalized, is a well-formed
+// ISBN-10 or ISBN-13 with a correct check digit.
+func validISBN(isbn string) bool {
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, c := range isbn {
+			var digit int
+			switch {
+			case c >= '0' && c <= '9':
+				digit = int(c - '0')
+			case c == 'X' && i == 9:
+				digit = 10
+			default:
+				return false
+			}
+			sum += digit * (10 - i)
+		}
+		return sum%11 == 0
+	case 13:
+		sum := 0
+		for i, c := range isbn {
+			if c < '0' || c > '9' {
+				return false
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += int(c-'0') * weight
+		}
+		return sum%10 == 0
+	default:
+		return false
+	}
+}
+
+// validateISBN records an error for value unless it is empty or a valid
+// ISBN; the field is optional.
+func validateISBN(errs fieldErrors, name, value string) {
+	if value == "" {
+		return
+	}
+	if !validISBN(normalizeISBN(value)) {
+		errs[name] = "must be a valid ISBN-10 or ISBN-13"
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateBookISBN(t *testing.T) {
+	tests := []struct {
+		name  string
+		isbn  string
+		valid bool
+	}{
+		{"none", "", true},
+		{"ISBN-13", "9780441172719", true},
+		{"ISBN-13 with hyphens", "978-0-441-17271-9", true},
+		{"ISBN-13 with spaces", "978 0 441 17271 9", true},
+		{"ISBN-10", "0441172717", true},
+		{"ISBN-10 with X check digit", "080442957X", true},
+		{"ISBN-10 with lower-case x", "080442957x", true},
+		{"ISBN-13 bad checksum", "9780441172710", false},
+		{"ISBN-10 bad checksum", "0441172718", false},
+		{"X before the end", "08044295X7", false},
+		{"X in ISBN-13", "978044117271X", false},
+		{"letters", "978O441172719", false},
+		{"too short", "978044117271", false},
+		{"too long", "97804411727190", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBook(Book{Title: "Dune", Author: "Frank Herbert", ISBN: tt.isbn})
+			var errs fieldErrors
+			invalid := errors.As(err, &errs) && errs["isbn"] != ""
+			if invalid == tt.valid {
+				t.Errorf("validateBook with ISBN %q: err = %v, want valid = %v", tt.isbn, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestNullableISBN(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want interface{}
+	}{
+		{"", nil},
+		{" - ", nil},
+		{"978-0-441-17271-9", "9780441172719"},
+		{"080442957x", "080442957X"},
+	}
+	for _, tt := range tests {
+		if got := nullableISBN(tt.isbn); got != tt.want {
+			t.Errorf("nullableISBN(%q) = %v, want %v", tt.isbn, got, tt.want)
+		}
+	}
+}
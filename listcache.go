@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultListCacheTTL is how long a page of the book list is served from
+// memory when LIST_CACHE_TTL is unset.
+const defaultListCacheTTL = 30 * time.Second
+
+// maxListCacheEntries caps the distinct pages kept, since every combination
+// of filters, sort and pagination is its own entry.
+const maxListCacheEntries = 1000
+
+// listPage is one page of the book list and the total it was counted from.
+type listPage struct {
+	books []Book
+	total int
+}
+
+type listCacheEntry struct {
+	page   listPage
+	stored time.Time
+}
+
+// listCall is a fetch in progress that other requests for the same page
+// wait on instead of querying too.
+type listCall struct {
+	done chan struct{}
+	page listPage
+	err  error
+}
+
+// listCache keeps recent pages of the book list for ttl, until the next
+// write. A nil *listCache caches nothing.
+type listCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[string]listCacheEntry
+	calls   map[string]*listCall
+	// generation counts invalidations, so a fetch that started before a
+	// write doesn't store what it read once the write has landed
+	generation uint64
+}
+
+// newListCache returns a cache keeping pages for ttl, or nil when ttl is
+// zero.
+func newListCache(ttl time.Duration) *listCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &listCache{ttl: ttl, entries: make(map[string]listCacheEntry), calls: make(map[string]*listCall)}
+}
+
+// get returns the page for key, calling fetch only when there is no fresh
+// copy and no other request is already fetching it. cached reports whether
+// the page came from memory, and age is then how old it is.
+func (c *listCache) get(key string, fetch func() (listPage, error)) (page listPage, age time.Duration, cached bool, err error) {
+	if c == nil {
+		page, err = fetch()
+		return page, 0, false, err
+	}
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+	if ok && time.Since(entry.stored) < c.ttl {
+		return entry.page, time.Since(entry.stored), true, nil
+	}
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && time.Since(entry.stored) < c.ttl {
+		c.mu.Unlock()
+		return entry.page, time.Since(entry.stored), true, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.page, 0, false, call.err
+	}
+	call := &listCall{done: make(chan struct{})}
+	c.calls[key] = call
+	generation := c.generation
+	c.mu.Unlock()
+
+	call.page, call.err = fetch()
+
+	c.mu.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	if call.err == nil && generation == c.generation {
+		if len(c.entries) >= maxListCacheEntries {
+			c.evictExpired()
+		}
+		if len(c.entries) < maxListCacheEntries {
+			c.entries[key] = listCacheEntry{page: call.page, stored: time.Now()}
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.page, 0, false, call.err
+}
+
+// evictExpired drops stale entries. c.mu must be held.
+func (c *listCache) evictExpired() {
+	for key, entry := range c.entries {
+		if time.Since(entry.stored) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// invalidate forgets every page, after a write has changed the catalog.
+// Fetches already running finish for the requests waiting on them but are
+// not stored.
+func (c *listCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]listCacheEntry)
+	c.calls = make(map[string]*listCall)
+}
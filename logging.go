@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logger receives every log line. main replaces it with a JSON logger at
+// the LOG_LEVEL level; until then it is slog's default.
+var logger = slog.Default()
+
+// newLogger returns a logger writing JSON lines of level and above to w.
+// Records logged with a request context carry its request_id.
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(requestIDHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+// parseLogLevel reads a LOG_LEVEL value: debug, info, warn or error, in any
+// case. Empty means info.
+func parseLogLevel(v string) (slog.Level, error) {
+	if v == "" {
+		return slog.LevelInfo, nil
+	}
+	var level slog.Level
+	err := level.UnmarshalText([]byte(v))
+	if err != nil {
+		return 0, fmt.Errorf("invalid LOG_LEVEL %q: use debug, info, warn or error", v)
+	}
+	return level, nil
+}
+
+// requestIDHandler adds the request id from the context to each record.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// logCtx logs v as an error, tagged with the request id from ctx if any.
+func logCtx(ctx context.Context, v ...interface{}) {
+	logger.ErrorContext(ctx, fmt.Sprint(v...))
+}
+
+// fatal logs msg and args as an error and exits.
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
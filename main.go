@@ -1,222 +1,2940 @@
-package main
-
-import (
-	"context"
-	"database/sql"
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"strconv"
-	"strings"
-	"time"
-
-	_ "github.com/go-sql-driver/mysql"
-)
-
-type Book struct {
-	ID     int    `json:"id"`
-	Title  string `json:"title"`
-	Author string `json:"author"`
-}
-
-const bookPath = "books"
-
-var Db *sql.DB
-
-const apibasePath = "/api"
-
-func getBook(bookid int) (*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	row := Db.QueryRowContext(ctx, `SELECT * FROM books WHERE id = ?`, bookid)
-
-	book := &Book{}
-	err := row.Scan(
-		&book.ID,
-		&book.Title,
-		&book.Author,
-	)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	} else if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	return book, nil
-}
-
-func removeBook(bookID int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err := Db.ExecContext(ctx, `DELETE FROM books WHERE id = ?`, bookID)
-	if err != nil {
-		log.Println(err.Error())
-		return err
-	}
-	return nil
-}
-
-func getBookList() ([]Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	results, err := Db.QueryContext(ctx, `SELECT * FROM books`)
-	if err != nil {
-		log.Println(err.Error())
-		return nil, err
-	}
-	defer results.Close()
-	books := make([]Book, 0)
-	for results.Next() {
-		var book Book
-		results.Scan(&book.ID,
-			&book.Title,
-			&book.Author)
-
-		books = append(books, book)
-	}
-	return books, nil
-}
-
-func insertBook(book Book) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	result, err := Db.ExecContext(ctx, `INSERT INTO books 
-	(id,
-	title,
-	author
-	)VALUES (?, ?, ?)`,
-		book.ID,
-		book.Title,
-		book.Author)
-	if err != nil {
-		log.Println(err.Error())
-		return 0, err
-	}
-	insertID, err := result.LastInsertId()
-	if err != nil {
-		log.Println(err.Error())
-		return 0, err
-	}
-	return int(insertID), nil
-}
-
-func handlerBooks(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		BookList, err := getBookList()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		json, err := json.Marshal(BookList)
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = w.Write(json)
-		if err != nil {
-			log.Fatal(err)
-		}
-	case http.MethodPost:
-		var book Book
-		err := json.NewDecoder(r.Body).Decode(&book)
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		BookID, err := insertBook(book)
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte(fmt.Sprintf(`{"bookid": %d}`, BookID)))
-	case http.MethodOptions:
-		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-}
-
-func handlerBook(w http.ResponseWriter, r *http.Request) {
-	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", bookPath))
-	if len(urlPathSegments[1:]) > 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	bookID, err := strconv.Atoi(urlPathSegments[len(urlPathSegments)-1])
-	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	switch r.Method {
-	case http.MethodGet:
-		book, err := getBook(bookID)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if book == nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		json, err := json.Marshal(book)
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		_, err = w.Write(json)
-		if err != nil {
-			log.Fatal(err)
-		}
-	case http.MethodDelete:
-		err := removeBook(bookID)
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-}
-
-func corsMiddleware(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Add("Content-Type", "application/่json")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Origin, X-Requested-With")
-		handler.ServeHTTP(w, r)
-	})
-}
-
-func SetupRoutes(apiBasePath string) {
-	bookHandler := http.HandlerFunc(handlerBook)
-	http.Handle(fmt.Sprintf("%s/%s/", apiBasePath, bookPath), corsMiddleware(bookHandler))
-	booksHandler := http.HandlerFunc(handlerBooks)
-	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, bookPath), corsMiddleware(booksHandler))
-}
-
-func SetupDB() {
-	var err error
-	Db, err = sql.Open("mysql", "root:root@tcp(127.0.0.1:3306)/bookdb")
-	if err != nil {
-		log.Fatal(err)
-	} else {
-		fmt.Println("success")
-	}
-	fmt.Println(Db)
-	Db.SetConnMaxLifetime(time.Minute * 3)
-	Db.SetMaxOpenConns(10)
-	Db.SetMaxIdleConns(10)
-}
-
-func main() {
-	SetupDB()
-	SetupRoutes(apibasePath)
-	log.Fatal(http.ListenAndServe(":5000", nil))
-}
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Book is one title in the catalog. Tags is only loaded when a single book
+// is read and by the JSON export, not for lists.
+type Book struct {
+	XMLName    xml.Name   `json:"-" xml:"book"`
+	ID         BookID     `json:"id" xml:"id"`
+	Title      string     `json:"title" xml:"title"`
+	Author     string     `json:"author" xml:"author"`
+	ISBN       string     `json:"isbn" xml:"isbn"`
+	Year       int        `json:"year" xml:"year"`
+	Genre      string     `json:"genre" xml:"genre"`
+	PriceCents Cents      `json:"price" xml:"price"`
+	Version    int        `json:"version" xml:"version"`
+	CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" xml:"updated_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+	Tags       []string   `json:"tags,omitempty" xml:"tags>tag,omitempty"`
+}
+
+const bookPath = "books"
+
+// duplicateTitleWarning is the Warning header on a created book whose title
+// another book already has.
+const duplicateTitleWarning = `199 - "possible duplicate title"`
+
+// Server holds the database connection and the state the handlers share.
+// Its methods are the handlers and the queries behind them.
+type Server struct {
+	db *sql.DB
+	// driver is the DB_DRIVER SetupDB connected with, so SQL that differs
+	// between MySQL and SQLite can branch on it.
+	driver string
+	stmts  statements
+	events *eventHub
+	stats  statsCache
+	// listCache holds recent pages of the book list; nil disables it.
+	listCache *listCache
+	// fullText is whether ?q= can use the books FULLTEXT index, which only
+	// MySQL has.
+	fullText bool
+}
+
+// NewServer connects to the database and readies it for the handlers.
+func NewServer() (*Server, error) {
+	s := &Server{events: &eventHub{}}
+	err := s.SetupDB()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+const apibasePath = "/api"
+
+const defaultPort = "5000"
+
+const defaultDSN = "root:root@tcp(127.0.0.1:3306)/bookdb"
+
+// Supported DB_DRIVER values.
+const (
+	driverMySQL  = "mysql"
+	driverSQLite = "sqlite3"
+)
+
+// defaultSQLiteDSN is used with DB_DRIVER=sqlite3 when DATABASE_DSN is
+// unset. The busy timeout lets concurrent writers wait instead of failing.
+const defaultSQLiteDSN = "file:bookdb.sqlite?_pragma=busy_timeout(5000)&_time_format=sqlite"
+
+// Connection pool defaults, overridable with DB_MAX_OPEN, DB_MAX_IDLE and
+// DB_CONN_MAX_LIFETIME. SQLite defaults to a single connection instead.
+const (
+	defaultDBMaxOpen         = 10
+	defaultDBMaxIdle         = 10
+	defaultDBConnMaxLifetime = 3 * time.Minute
+)
+
+// The per-client rate limit defaults, overridable with RATE_LIMIT_RPS and
+// RATE_LIMIT_BURST. A rate of 0 disables limiting.
+const (
+	defaultRateLimitRPS   = "10"
+	defaultRateLimitBurst = "20"
+)
+
+// defaultPageLimit is the page size when a request sends no limit, and
+// maxPageLimit the largest limit a request may send. They can be changed
+// with DEFAULT_PAGE_SIZE and MAX_PAGE_SIZE. A limit in the request always
+// wins over DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE bounds both, and a default
+// above the max is lowered to it.
+var (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// dbTimeout is the upper bound on any single database call, on top of
+// whatever deadline the request context already carries.
+const dbTimeout = 3 * time.Second
+
+// shutdownTimeout is how long in-flight requests get to finish once a
+// shutdown signal arrives.
+const shutdownTimeout = 10 * time.Second
+
+// SetupDB retries the initial connection with exponential backoff, starting
+// at dbConnectInitialBackoff and capped at dbConnectMaxBackoff, for up to
+// dbConnectTimeout in total.
+const (
+	dbConnectTimeout        = 30 * time.Second
+	dbConnectInitialBackoff = 500 * time.Millisecond
+	dbConnectMaxBackoff     = 5 * time.Second
+)
+
+// healthTimeout bounds the DB ping in handlerHealth so probes stay cheap.
+const healthTimeout = time.Second
+
+var errBookNotFound = errors.New("book not found")
+
+// errDuplicateISBN means another book already has the ISBN being written.
+var errDuplicateISBN = errors.New("a book with this ISBN already exists")
+
+// mysqlDuplicateEntry is the MySQL error number for a unique key violation.
+const mysqlDuplicateEntry = 1062
+
+// isUniqueViolation reports whether err is a unique or primary key
+// violation from either driver.
+func isUniqueViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return true
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code()
+		return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+// translateWriteError maps driver errors the handlers care about onto the
+// package's sentinel errors.
+func translateWriteError(err error) error {
+	if isUniqueViolation(err) {
+		return errDuplicateISBN
+	}
+	return err
+}
+
+// errVersionConflict means the client's copy of a book is out of date.
+var errVersionConflict = errors.New("book version conflict")
+
+// maxBatchSize caps how many books a single bulk request may create or
+// delete.
+const maxBatchSize = 1000
+
+// maxBodyBytes caps the size of a request body. It defaults to 1MB and can
+// be changed with MAX_BODY_BYTES.
+var maxBodyBytes int64 = 1 << 20
+
+// requestTimeout bounds how long an API handler may run before the client
+// gets a 503 and the request context is cancelled. It defaults to 10s and
+// can be changed with REQUEST_TIMEOUT; 0 disables it.
+var requestTimeout = 10 * time.Second
+
+// maxFieldLength matches the VARCHAR(255) title and author columns.
+const maxFieldLength = 255
+
+// maxGenreLength matches the VARCHAR(64) genre column.
+const maxGenreLength = 64
+
+// fieldErrors maps a JSON field name to what is wrong with it.
+type fieldErrors map[string]string
+
+func (e fieldErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+": "+e[name])
+	}
+	return strings.Join(parts, "; ")
+}
+
+func validateRequired(errs fieldErrors, name, value string) {
+	if strings.TrimSpace(value) == "" {
+		errs[name] = "must not be empty"
+	} else if utf8.RuneCountInString(value) > maxFieldLength {
+		errs[name] = fmt.Sprintf("must be at most %d characters", maxFieldLength)
+	}
+}
+
+// minBookYear is the earliest publication year accepted, roughly the start
+// of movable-type printing in Europe.
+const minBookYear = 1400
+
+// validateYear accepts 0 (unknown) or a year between minBookYear and next
+// year, which leaves room for announced titles.
+func validateYear(errs fieldErrors, name string, year int) {
+	maxYear := time.Now().Year() + 1
+	if year != 0 && (year < minBookYear || year > maxYear) {
+		errs[name] = fmt.Sprintf("must be between %d and %d", minBookYear, maxYear)
+	}
+}
+
+// validateGenre accepts an empty genre (uncategorized) or one of at most
+// maxGenreLength characters.
+func validateGenre(errs fieldErrors, name, genre string) {
+	if utf8.RuneCountInString(genre) > maxGenreLength {
+		errs[name] = fmt.Sprintf("must be at most %d characters", maxGenreLength)
+	}
+}
+
+// nullableString returns s for storage, or nil when it is empty.
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullableInt returns n for storage, or nil when it is zero.
+func nullableInt(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// validateField applies the rule for the named book field to value.
+func validateField(errs fieldErrors, name, value string) {
+	switch name {
+	case "title", "author":
+		validateRequired(errs, name, value)
+	case "isbn":
+		validateISBN(errs, name, value)
+	case "genre":
+		validateGenre(errs, name, value)
+	case "price":
+		price, err := parsePrice(value)
+		if err != nil {
+			errs[name] = err.Error()
+			return
+		}
+		validatePrice(errs, name, price)
+	}
+}
+
+// validateBook checks the client-supplied fields of b. It returns a
+// fieldErrors describing every invalid field, or nil.
+func validateBook(b Book) error {
+	errs := fieldErrors{}
+	validateField(errs, "title", b.Title)
+	validateField(errs, "author", b.Author)
+	validateField(errs, "isbn", b.ISBN)
+	validateField(errs, "genre", b.Genre)
+	validateYear(errs, "year", b.Year)
+	validatePrice(errs, "price", b.PriceCents)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// requiredBookFields picks out the keys a create or replace must send.
+// The pointers tell an omitted key (nil) apart from an empty string, which
+// decoding straight into Book cannot.
+type requiredBookFields struct {
+	Title  *string `json:"title"`
+	Author *string `json:"author"`
+}
+
+// decodeBook strictly decodes one book from raw.
+func decodeBook(raw json.RawMessage) (Book, error) {
+	var book Book
+	err := newStrictDecoder(bytes.NewReader(raw)).Decode(&book)
+	return book, err
+}
+
+// validateBookPayload reports required keys missing from raw as well as
+// everything validateBook finds in book, which must be decoded from raw.
+func validateBookPayload(raw json.RawMessage, book Book) error {
+	var present requiredBookFields
+	err := json.Unmarshal(raw, &present)
+	if err != nil {
+		return err
+	}
+	errs := fieldErrors{}
+	if present.Title == nil {
+		errs["title"] = "is required"
+	}
+	if present.Author == nil {
+		errs["author"] = "is required"
+	}
+	var bookErrs fieldErrors
+	if errors.As(validateBook(book), &bookErrs) {
+		for name, message := range bookErrs {
+			// "is required" says more than "must not be empty"
+			if _, missing := errs[name]; !missing {
+				errs[name] = message
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// bookColumns is the column list every book read selects. It must stay in
+// the same order as the destinations in scanBook.
+const bookColumns = "id, title, author, isbn, year, genre, price_cents, version, created_at, updated_at, deleted_at"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBook(row rowScanner, book *Book) error {
+	var isbn sql.NullString
+	var year sql.NullInt64
+	var genre sql.NullString
+	var price sql.NullInt64
+	var deletedAt sql.NullTime
+	err := row.Scan(
+		&book.ID,
+		&book.Title,
+		&book.Author,
+		&isbn,
+		&year,
+		&genre,
+		&price,
+		&book.Version,
+		&book.CreatedAt,
+		&book.UpdatedAt,
+		&deletedAt,
+	)
+	book.ISBN = isbn.String
+	book.Year = int(year.Int64)
+	book.Genre = genre.String
+	book.PriceCents = Cents(price.Int64)
+	book.DeletedAt = nil
+	if deletedAt.Valid {
+		book.DeletedAt = &deletedAt.Time
+	}
+	return err
+}
+
+// getBook returns the book with bookid, or nil if it doesn't exist or has
+// been soft-deleted.
+func (s *Server) getBook(ctx context.Context, bookid int) (*Book, error) {
+	return s.fetchBook(ctx, bookid, false)
+}
+
+// fetchBook is getBook with the option of also returning soft-deleted books.
+func (s *Server) fetchBook(ctx context.Context, bookid int, includeDeleted bool) (*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	stmt := s.stmts.getBook
+	if includeDeleted {
+		stmt = s.stmts.getBookDeleted
+	}
+	book := &Book{}
+	err := s.retryDB(ctx, func() error {
+		return scanBook(stmt.QueryRowContext(ctx, bookid), book)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	book.Tags, err = s.bookTags(ctx, bookid)
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// rowQueryer is satisfied by both *sql.DB and *sql.Tx.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// bookIsLive reports whether a book with bookID exists and hasn't been
+// soft-deleted, using q so it can run inside a transaction.
+func bookIsLive(ctx context.Context, q rowQueryer, bookID int) (bool, error) {
+	var one int
+	err := q.QueryRowContext(ctx, `SELECT 1 FROM books WHERE id = ? AND deleted_at IS NULL`, bookID).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// bookExists reports whether a book that hasn't been soft-deleted has
+// bookID. It is cheaper than getBook when the columns aren't needed.
+func (s *Server) bookExists(ctx context.Context, bookID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var exists bool
+	err := s.retryDB(ctx, func() error {
+		var err error
+		exists, err = bookIsLive(ctx, s.db, bookID)
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// titleExists reports whether a book that hasn't been soft-deleted already
+// has title, ignoring case.
+func (s *Server) titleExists(ctx context.Context, title string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var exists bool
+	err := s.retryDB(ctx, func() error {
+		var one int
+		err := s.db.QueryRowContext(ctx, `SELECT 1 FROM books WHERE LOWER(title) = LOWER(?) AND deleted_at IS NULL LIMIT 1`, title).Scan(&one)
+		if err == sql.ErrNoRows {
+			exists = false
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// withTx runs fn inside a transaction, committing if it returns nil and
+// rolling back otherwise. A transaction that loses its connection before
+// committing is retried once, so fn may run twice.
+func (s *Server) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	var commitErr error
+	err := s.runDB(ctx, callerName(1), func() error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		err = fn(tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		// a failed commit may still have been applied, so it is never retried
+		commitErr = tx.Commit()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return commitErr
+}
+
+// removeBook soft-deletes the book by stamping deleted_at, bumping its
+// version and updated_at as any other change does. It returns
+// errBookNotFound if the book doesn't exist or is already deleted.
+func (s *Server) removeBook(ctx context.Context, bookID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	now := time.Now().UTC()
+	var rowsAffected int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE books SET
+		deleted_at = ?,
+		version = version + 1,
+		updated_at = ?
+		WHERE id = ? AND deleted_at IS NULL`,
+			now, now, bookID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return err
+	}
+	if rowsAffected == 0 {
+		return errBookNotFound
+	}
+	return nil
+}
+
+// placeholders returns n comma-separated "?" for an IN (...) list.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// removeBooks soft-deletes every listed book in one transaction, like
+// removeBook, and returns the ids that were actually deleted; unknown or
+// already deleted ids are skipped.
+func (s *Server) removeBooks(ctx context.Context, bookIDs []int) ([]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	args := make([]interface{}, 0, len(bookIDs))
+	for _, id := range bookIDs {
+		args = append(args, id)
+	}
+	var deleted []int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		deleted = deleted[:0]
+		rows, err := tx.QueryContext(ctx, `SELECT id FROM books WHERE id IN (`+placeholders(len(bookIDs))+`) AND deleted_at IS NULL`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			deleted = append(deleted, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(deleted) == 0 {
+			return nil
+		}
+		now := time.Now().UTC()
+		ids := make([]interface{}, 0, len(deleted)+2)
+		ids = append(ids, now, now)
+		for _, id := range deleted {
+			ids = append(ids, id)
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE books SET
+		deleted_at = ?,
+		version = version + 1,
+		updated_at = ?
+		WHERE id IN (`+placeholders(len(deleted))+`)`, ids...)
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// restoreBook clears deleted_at on a soft-deleted book. It returns
+// errBookNotFound if there is no deleted book with bookID.
+func (s *Server) restoreBook(ctx context.Context, bookID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var rowsAffected int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE books SET 
+		deleted_at = NULL,
+		version = version + 1,
+		updated_at = ?
+		WHERE id = ? AND deleted_at IS NOT NULL`,
+			time.Now().UTC(), bookID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return translateWriteError(err)
+	}
+	if rowsAffected == 0 {
+		return errBookNotFound
+	}
+	return nil
+}
+
+// missingOrStale explains why a versioned UPDATE matched no rows: either the
+// book doesn't exist, or it does and the expected version was stale.
+func (s *Server) missingOrStale(ctx context.Context, bookID, version int) error {
+	if version == 0 {
+		return errBookNotFound
+	}
+	exists, err := s.bookExists(ctx, bookID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errBookNotFound
+	}
+	return errVersionConflict
+}
+
+// updateBook replaces the book's fields and bumps its version. When
+// book.Version is non-zero the update only applies if it still matches the
+// stored version, otherwise errVersionConflict is returned; a zero version
+// skips the check.
+func (s *Server) updateBook(ctx context.Context, book Book) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	query := `UPDATE books SET 
+	title = ?,
+	author = ?,
+	isbn = ?,
+	year = ?,
+	genre = ?,
+	price_cents = ?,
+	version = version + 1,
+	updated_at = ?
+	WHERE id = ? AND deleted_at IS NULL`
+	args := []interface{}{book.Title, storedAuthor(book.Author), nullableISBN(book.ISBN), nullableInt(book.Year), nullableString(book.Genre), nullablePrice(book.PriceCents), time.Now().UTC(), int(book.ID)}
+	if book.Version != 0 {
+		query += ` AND version = ?`
+		args = append(args, book.Version)
+	}
+	var rowsAffected int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return translateWriteError(err)
+	}
+	if rowsAffected == 0 {
+		return s.missingOrStale(ctx, int(book.ID), book.Version)
+	}
+	return nil
+}
+
+// patchableFields lists the columns a PATCH may touch, in the order they
+// appear in the generated SET clause. id is deliberately absent.
+var patchableFields = []string{"title", "author", "isbn", "year", "genre", "price"}
+
+// numericPatchFields are the patchable fields that take a JSON number
+// rather than a string.
+var numericPatchFields = map[string]bool{"year": true}
+
+// requiredPatchFields are the patchable fields a null may not clear.
+var requiredPatchFields = map[string]bool{"title": true, "author": true}
+
+// mergePatchType is the media type of a JSON Merge Patch (RFC 7386), the
+// format PATCH takes.
+const mergePatchType = "application/merge-patch+json"
+
+// isMergePatch reports whether r's body is declared as a merge patch. Plain
+// application/json, or no Content-Type at all, is accepted too, since that
+// is what PATCH took before it followed RFC 7386.
+func isMergePatch(r *http.Request) bool {
+	v := r.Header.Get("Content-Type")
+	if v == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(v)
+	return err == nil && (mediaType == mergePatchType || mediaType == "application/json")
+}
+
+// isJSONNull reports whether raw is the JSON literal null.
+func isJSONNull(raw json.RawMessage) bool {
+	return string(bytes.TrimSpace(raw)) == "null"
+}
+
+// BookUpdate is a decoded PATCH body. Unlike Book, it tells a field the
+// patch leaves alone (a nil pointer) apart from one it sets to an empty
+// value, and Cleared names the fields it sets to null.
+type BookUpdate struct {
+	Title   *string
+	Author  *string
+	ISBN    *string
+	Year    *int
+	Genre   *string
+	Price   *string
+	Cleared map[string]bool
+}
+
+// decodeBookUpdate builds a BookUpdate from the members of a merge patch,
+// which must already be restricted to patchableFields and version. Errors
+// describe a member of the wrong JSON type.
+func decodeBookUpdate(fields map[string]json.RawMessage) (BookUpdate, error) {
+	update := BookUpdate{Cleared: make(map[string]bool)}
+	for _, name := range patchableFields {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if isJSONNull(raw) {
+			update.Cleared[name] = true
+			continue
+		}
+		if numericPatchFields[name] {
+			var n int
+			if json.Unmarshal(raw, &n) != nil {
+				return BookUpdate{}, fmt.Errorf("%s must be an integer or null", name)
+			}
+			update.Year = &n
+			continue
+		}
+		var str string
+		if json.Unmarshal(raw, &str) != nil {
+			return BookUpdate{}, fmt.Errorf("%s must be a string or null", name)
+		}
+		switch name {
+		case "title":
+			update.Title = &str
+		case "author":
+			update.Author = &str
+		case "isbn":
+			update.ISBN = &str
+		case "genre":
+			update.Genre = &str
+		case "price":
+			update.Price = &str
+		}
+	}
+	return update, nil
+}
+
+// empty reports whether u changes nothing.
+func (u BookUpdate) empty() bool {
+	return u.Title == nil && u.Author == nil && u.ISBN == nil && u.Year == nil &&
+		u.Genre == nil && u.Price == nil && len(u.Cleared) == 0
+}
+
+// validate checks the fields u sets, as validateBook does for a whole book.
+func (u BookUpdate) validate() error {
+	errs := fieldErrors{}
+	for name := range u.Cleared {
+		if requiredPatchFields[name] {
+			errs[name] = "cannot be cleared"
+		}
+	}
+	for name, value := range map[string]*string{"title": u.Title, "author": u.Author, "isbn": u.ISBN, "genre": u.Genre, "price": u.Price} {
+		if value != nil {
+			validateField(errs, name, *value)
+		}
+	}
+	if u.Year != nil {
+		validateYear(errs, "year", *u.Year)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// patchBook updates only the columns update sets or clears, which it must
+// have been validated for. version works as in updateBook.
+func (s *Server) patchBook(ctx context.Context, bookID int, update BookUpdate, version int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var assignments []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		assignments = append(assignments, column+" = ?")
+		args = append(args, value)
+	}
+	if update.Title != nil {
+		set("title", *update.Title)
+	}
+	if update.Author != nil {
+		set("author", storedAuthor(*update.Author))
+	}
+	if update.ISBN != nil {
+		set("isbn", nullableISBN(*update.ISBN))
+	}
+	if update.Year != nil {
+		set("year", nullableInt(*update.Year))
+	}
+	if update.Genre != nil {
+		set("genre", nullableString(*update.Genre))
+	}
+	if update.Price != nil {
+		// already checked by validate
+		price, _ := parsePrice(*update.Price)
+		set("price_cents", nullablePrice(price))
+	}
+	for _, name := range patchableFields {
+		if update.Cleared[name] {
+			column := name
+			if name == "price" {
+				column = "price_cents"
+			}
+			assignments = append(assignments, column+" = NULL")
+		}
+	}
+	assignments = append(assignments, "version = version + 1", "updated_at = ?")
+	query := `UPDATE books SET ` + strings.Join(assignments, ", ") + ` WHERE id = ? AND deleted_at IS NULL`
+	args = append(args, time.Now().UTC(), bookID)
+	if version != 0 {
+		query += ` AND version = ?`
+		args = append(args, version)
+	}
+	var rowsAffected int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return translateWriteError(err)
+	}
+	if rowsAffected == 0 {
+		return s.missingOrStale(ctx, bookID, version)
+	}
+	return nil
+}
+
+// bookFilter holds the optional list filters; the zero value matches every
+// book that hasn't been soft-deleted.
+type bookFilter struct {
+	Title          string
+	Author         string
+	YearMin        int
+	YearMax        int
+	Genre          string
+	PriceMax       Cents
+	IncludeDeleted bool
+	// Query is the ?q= search over title and author.
+	Query string
+	// fullText matches Query with MATCH ... AGAINST on the FULLTEXT index;
+	// without it Query is a case-insensitive substring match on either.
+	fullText bool
+	// ExactAuthor must equal the author, unlike the substring Author.
+	ExactAuthor string
+	// Tag, already normalized, must be one of the book's tags.
+	Tag string
+	// AfterID restricts the match to ids greater than it, for keyset
+	// pagination. It is left out when counting the total.
+	AfterID int
+}
+
+// fullTextMatch is the relevance of title and author to a search, nonzero
+// for rows that match at all.
+const fullTextMatch = "MATCH(title, author) AGAINST (? IN NATURAL LANGUAGE MODE)"
+
+// likeEscaper escapes LIKE wildcards with "!", which unlike backslash means
+// the same thing in MySQL and SQLite string literals.
+var likeEscaper = strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`)
+
+// where builds the WHERE clause and its arguments for the filter. Title and
+// author are a case-insensitive substring match, with LIKE wildcards in the
+// terms escaped; genre must match exactly. Query is described on the field.
+func (f bookFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if !f.IncludeDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+	if f.Title != "" {
+		conditions = append(conditions, "LOWER(title) LIKE ? ESCAPE '!'")
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(f.Title))+"%")
+	}
+	if f.Author != "" {
+		conditions = append(conditions, "LOWER(author) LIKE ? ESCAPE '!'")
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(f.Author))+"%")
+	}
+	if f.ExactAuthor != "" {
+		conditions = append(conditions, "author = ?")
+		args = append(args, f.ExactAuthor)
+	}
+	if f.Query != "" {
+		if f.fullText {
+			conditions = append(conditions, fullTextMatch)
+			args = append(args, f.Query)
+		} else {
+			term := "%" + likeEscaper.Replace(strings.ToLower(f.Query)) + "%"
+			conditions = append(conditions, "(LOWER(title) LIKE ? ESCAPE '!' OR LOWER(author) LIKE ? ESCAPE '!')")
+			args = append(args, term, term)
+		}
+	}
+	if f.Genre != "" {
+		conditions = append(conditions, "genre = ?")
+		args = append(args, f.Genre)
+	}
+	if f.Tag != "" {
+		conditions = append(conditions, "id IN (SELECT bt.book_id FROM book_tags bt JOIN tags t ON t.id = bt.tag_id WHERE t.name = ?)")
+		args = append(args, f.Tag)
+	}
+	if f.PriceMax != 0 {
+		// books without a price never match a price ceiling
+		conditions = append(conditions, "price_cents <= ?")
+		args = append(args, int64(f.PriceMax))
+	}
+	switch {
+	case f.YearMin != 0 && f.YearMax != 0:
+		conditions = append(conditions, "year BETWEEN ? AND ?")
+		args = append(args, f.YearMin, f.YearMax)
+	case f.YearMin != 0:
+		conditions = append(conditions, "year >= ?")
+		args = append(args, f.YearMin)
+	case f.YearMax != 0:
+		conditions = append(conditions, "year <= ?")
+		args = append(args, f.YearMax)
+	}
+	if f.AfterID != 0 {
+		conditions = append(conditions, "id > ?")
+		args = append(args, f.AfterID)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// sortColumns whitelists the ?sort= keys and the column each one orders by,
+// so user input never reaches the SQL directly.
+var sortColumns = map[string]string{
+	"id":     "id",
+	"title":  "title",
+	"author": "author",
+}
+
+// bookSort is a validated ORDER BY; the zero value sorts by id ascending.
+type bookSort struct {
+	column string
+	desc   bool
+}
+
+// parseSort turns a ?sort= value such as "title" or "-author" into a bookSort.
+func parseSort(v string) (bookSort, error) {
+	if v == "" {
+		return bookSort{}, nil
+	}
+	var order bookSort
+	key := v
+	if strings.HasPrefix(key, "-") {
+		order.desc = true
+		key = key[1:]
+	}
+	column, ok := sortColumns[key]
+	if !ok {
+		return bookSort{}, fmt.Errorf("invalid sort %q", v)
+	}
+	order.column = column
+	return order, nil
+}
+
+func (s bookSort) orderBy() string {
+	column := s.column
+	if column == "" {
+		column = "id"
+	}
+	direction := "ASC"
+	if s.desc {
+		direction = "DESC"
+	}
+	// id breaks ties so pages stay stable when the sort column repeats
+	if column != "id" {
+		return " ORDER BY " + column + " " + direction + ", id ASC"
+	}
+	return " ORDER BY id " + direction
+}
+
+func (s *Server) countBooks(ctx context.Context, filter bookFilter) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	where, args := filter.where()
+	var count int
+	err := s.retryDB(ctx, func() error {
+		return s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM books`+where, args...).Scan(&count)
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *Server) getBookList(ctx context.Context, filter bookFilter, order bookSort, limit, offset int) ([]Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	where, args := filter.where()
+	args = append(args, limit, offset)
+	var books []Book
+	err := s.retryDB(ctx, func() error {
+		var err error
+		books, err = s.queryBooks(ctx, `SELECT `+bookColumns+` FROM books`+where+order.orderBy()+` LIMIT ? OFFSET ?`, args...)
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return books, nil
+}
+
+// searchBooksFullText lists the books matching filter, whose Query must be
+// set, most relevant first. Without the FULLTEXT index there is no score to
+// rank by and it lists them by id like getBookList.
+func (s *Server) searchBooksFullText(ctx context.Context, filter bookFilter, limit, offset int) ([]Book, error) {
+	if !filter.fullText {
+		return s.getBookList(ctx, filter, bookSort{}, limit, offset)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	where, args := filter.where()
+	args = append(args, filter.Query, limit, offset)
+	var books []Book
+	err := s.retryDB(ctx, func() error {
+		var err error
+		books, err = s.queryBooks(ctx, `SELECT `+bookColumns+` FROM books`+where+` ORDER BY `+fullTextMatch+` DESC, id ASC LIMIT ? OFFSET ?`, args...)
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return books, nil
+}
+
+// hasFullTextIndex reports whether the books table has a FULLTEXT index, as
+// migration 5 creates on MySQL.
+func (s *Server) hasFullTextIndex(ctx context.Context) (bool, error) {
+	if s.driver == driverSQLite {
+		return false, nil
+	}
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.statistics
+	WHERE table_schema = DATABASE() AND table_name = 'books' AND index_type = 'FULLTEXT'`).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// queryBooks runs a SELECT of bookColumns and scans every row.
+func (s *Server) queryBooks(ctx context.Context, query string, args ...interface{}) ([]Book, error) {
+	results, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	books := make([]Book, 0)
+	for results.Next() {
+		var book Book
+		if err := scanBook(results, &book); err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// insertBook stores book and returns the id MySQL assigned to it; any id
+// set on book is ignored.
+func (s *Server) insertBook(ctx context.Context, book Book) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var id int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		id, err = s.execInsertBook(ctx, tx, book)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// insertBooks stores all of books in one transaction and returns their ids
+// in the same order. If any insert fails nothing is written.
+func (s *Server) insertBooks(ctx context.Context, books []Book) ([]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	ids := make([]int, 0, len(books))
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		ids = ids[:0]
+		for _, book := range books {
+			id, err := s.execInsertBook(ctx, tx, book)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+// execInsertBook inserts book as part of tx using the prepared
+// insert statement.
+func (s *Server) execInsertBook(ctx context.Context, tx *sql.Tx, book Book) (int, error) {
+	now := time.Now().UTC()
+	result, err := tx.StmtContext(ctx, s.stmts.insertBook).ExecContext(ctx,
+		book.Title,
+		storedAuthor(book.Author),
+		nullableISBN(book.ISBN),
+		nullableInt(book.Year),
+		nullableString(book.Genre),
+		nullablePrice(book.PriceCents),
+		now,
+		now)
+	if err != nil {
+		logCtx(ctx, err)
+		return 0, translateWriteError(err)
+	}
+	insertID, err := result.LastInsertId()
+	if err != nil {
+		logCtx(ctx, err)
+		return 0, err
+	}
+	return int(insertID), nil
+}
+
+// upsertBook inserts book, or if a book with the same ISBN exists replaces
+// its fields instead, reviving it if it was soft-deleted. book.ISBN must be
+// set. It returns the book's id and whether it was newly created.
+func (s *Server) upsertBook(ctx context.Context, book Book) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	now := time.Now().UTC()
+	args := []interface{}{book.Title, storedAuthor(book.Author), nullableISBN(book.ISBN), nullableInt(book.Year), nullableString(book.Genre), nullablePrice(book.PriceCents), now, now}
+	insert := `INSERT INTO books (title, author, isbn, year, genre, price_cents, version, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?)`
+	var id int
+	var created bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if s.driver == driverSQLite {
+			// SQLite reports one affected row either way, so look first;
+			// with a single connection nothing can interleave
+			var existing int
+			err := tx.QueryRowContext(ctx, `SELECT id FROM books WHERE isbn = ?`, nullableISBN(book.ISBN)).Scan(&existing)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			created = err == sql.ErrNoRows
+			return tx.QueryRowContext(ctx, insert+` ON CONFLICT(isbn) DO UPDATE SET
+			title = excluded.title,
+			author = excluded.author,
+			year = excluded.year,
+			genre = excluded.genre,
+			price_cents = excluded.price_cents,
+			version = version + 1,
+			updated_at = excluded.updated_at,
+			deleted_at = NULL
+			RETURNING id`, args...).Scan(&id)
+		}
+		// LAST_INSERT_ID(id) makes LastInsertId report the existing row's
+		// id on update; the always-changing updated_at means an update is
+		// always counted as 2 affected rows, an insert as 1
+		result, err := tx.ExecContext(ctx, insert+` ON DUPLICATE KEY UPDATE
+		id = LAST_INSERT_ID(id),
+		title = VALUES(title),
+		author = VALUES(author),
+		year = VALUES(year),
+		genre = VALUES(genre),
+		price_cents = VALUES(price_cents),
+		version = version + 1,
+		updated_at = VALUES(updated_at),
+		deleted_at = NULL`, args...)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		created = rowsAffected == 1
+		insertID, err := result.LastInsertId()
+		id = int(insertID)
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return 0, false, translateWriteError(err)
+	}
+	return id, created, nil
+}
+
+// errAdminOnly is returned when a non-admin asks for an admin-only view.
+var errAdminOnly = errors.New("include_deleted requires a valid API key")
+
+// parseIncludeDeleted reads ?include_deleted=true, which only admins may use.
+func parseIncludeDeleted(r *http.Request) (bool, error) {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return false, nil
+	}
+	if !isAdmin(r) {
+		return false, errAdminOnly
+	}
+	return true, nil
+}
+
+// parseYearParam reads an optional year query param; 0 means unset.
+func parseYearParam(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	year, err := strconv.Atoi(v)
+	if err != nil || year <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return year, nil
+}
+
+// parseBookFilter reads the list filters shared by the list and count
+// endpoints. Errors are bad requests, except errAdminOnly.
+func (s *Server) parseBookFilter(r *http.Request) (bookFilter, error) {
+	includeDeleted, err := parseIncludeDeleted(r)
+	if err != nil {
+		return bookFilter{}, err
+	}
+	yearMin, err := parseYearParam(r, "year_min")
+	if err != nil {
+		return bookFilter{}, err
+	}
+	yearMax, err := parseYearParam(r, "year_max")
+	if err != nil {
+		return bookFilter{}, err
+	}
+	if yearMin != 0 && yearMax != 0 && yearMin > yearMax {
+		return bookFilter{}, fmt.Errorf("year_min %d is after year_max %d", yearMin, yearMax)
+	}
+	var priceMax Cents
+	if v := r.URL.Query().Get("price_max"); v != "" {
+		priceMax, err = parsePrice(v)
+		if err != nil || priceMax <= 0 {
+			return bookFilter{}, fmt.Errorf(`price_max must be a positive decimal such as "12.99"`)
+		}
+	}
+	return bookFilter{
+		Title:          r.URL.Query().Get("title"),
+		Author:         r.URL.Query().Get("author"),
+		YearMin:        yearMin,
+		YearMax:        yearMax,
+		Genre:          r.URL.Query().Get("genre"),
+		Tag:            normalizeTag(r.URL.Query().Get("tag")),
+		PriceMax:       priceMax,
+		IncludeDeleted: includeDeleted,
+		Query:          strings.TrimSpace(r.URL.Query().Get("q")),
+		fullText:       s.fullText,
+	}, nil
+}
+
+// writeFilterError responds to an error from parseBookFilter.
+func writeFilterError(w http.ResponseWriter, err error) {
+	if err == errAdminOnly {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, err.Error())
+}
+
+// parseBookID parses the id segment of a book path. It wraps
+// strconv.ErrSyntax when s isn't a number and otherwise reports an id that
+// can't name a book, because it is zero, negative or too large.
+func parseBookID(s string) (int, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("invalid id: %s is out of range", s)
+	} else if err != nil {
+		return 0, err
+	}
+	if id <= 0 {
+		return 0, errors.New("invalid id: must be a positive integer")
+	}
+	return int(id), nil
+}
+
+// parseCursor reads the ?after= keyset cursor. The second return value is
+// false when the param is absent, meaning offset pagination applies.
+func parseCursor(r *http.Request) (int, bool, error) {
+	v := r.URL.Query().Get("after")
+	if v == "" {
+		return 0, false, nil
+	}
+	afterID, err := strconv.Atoi(v)
+	if err != nil || afterID < 0 {
+		return 0, false, fmt.Errorf("invalid after %q", v)
+	}
+	return afterID, true, nil
+}
+
+// parsePagination reads the limit and offset query params, falling back to
+// the defaults when they are absent. A limit above maxPageLimit is an
+// error rather than being quietly cut down, so a client never mistakes a
+// short page for the end of the list.
+func parsePagination(r *http.Request) (int, int, error) {
+	limit, offset := defaultPageLimit, 0
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid limit %q", v)
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", v)
+		}
+		offset = n
+	}
+	if limit > maxPageLimit {
+		return 0, 0, fmt.Errorf("limit must be at most %d", maxPageLimit)
+	}
+	return limit, offset, nil
+}
+
+// writeJSONError writes status along with a {"error": message} JSON body.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message}, false)
+}
+
+// prettyJSON reports whether the client asked for indented JSON with
+// ?pretty=true, which is easier to read from curl.
+func prettyJSON(r *http.Request) bool {
+	return r.URL.Query().Get("pretty") == "true"
+}
+
+// writeJSON responds with status and v encoded as JSON, indented when
+// pretty is set. v is encoded before anything is written, so a value that
+// can't be encoded still gets a proper 500 instead of a 200 with a broken
+// body.
+func writeJSON(w http.ResponseWriter, status int, v interface{}, pretty bool) {
+	var body []byte
+	var err error
+	if pretty {
+		body, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		logger.Error("encoding response", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "could not encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(body)
+	if err != nil {
+		// the client has gone away; the status is already sent
+		logger.Error("writing response", "error", err)
+	}
+}
+
+// statusClientClosedRequest is the non-standard status nginx uses for a
+// client that hung up before the response was ready.
+const statusClientClosedRequest = 499
+
+// writeDBError responds to a failed database call. A call that found the
+// connection pool exhausted is a 503 with Retry-After, so clients back off.
+// One that ran out of time is a 504, so slow queries can be told apart from
+// real faults, and one cut short because the client went away gets a bare
+// 499 that nobody will read. Anything else is a 500 with message.
+func writeDBError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, errPoolExhausted):
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusServiceUnavailable, "database busy, try again later")
+	case errors.Is(err, context.DeadlineExceeded):
+		writeJSONError(w, http.StatusGatewayTimeout, "database timeout")
+	case errors.Is(err, context.Canceled):
+		w.WriteHeader(statusClientClosedRequest)
+	default:
+		writeJSONError(w, http.StatusInternalServerError, message)
+	}
+}
+
+// newStrictDecoder returns a JSON decoder that rejects fields the target
+// struct doesn't declare, so client typos fail loudly.
+func newStrictDecoder(r io.Reader) *json.Decoder {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return dec
+}
+
+// writeDecodeError responds to a failure reading or decoding a request body,
+// using 413 when the body was cut off by maxBodyBytes and naming the field
+// when the body had one the decoder didn't allow.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit))
+		return
+	}
+	// a JSON number for price is refused too, since it may already have
+	// been rounded through a float on the client
+	var typeErr *json.UnmarshalTypeError
+	if errors.Is(err, errInvalidPrice) || (errors.As(err, &typeErr) && typeErr.Field == "price") {
+		writeValidationError(w, fieldErrors{"price": errInvalidPrice.Error()})
+		return
+	}
+	if errors.Is(err, errInvalidID) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// encoding/json has no typed error for this case, only the message
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		writeJSONError(w, http.StatusBadRequest, "unknown field "+field)
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+}
+
+// writeMethodNotAllowed responds 405 with the Allow header set to allowed.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// corsMaxAge is how long a browser may cache a preflight response. Chrome
+// caps it at two hours.
+const corsMaxAge = 2 * time.Hour
+
+// writePreflight answers an OPTIONS request to a route that accepts the
+// allowed methods. corsMiddleware has already set the other CORS headers.
+func writePreflight(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	w.Header().Set("Access-Control-Allow-Methods", allowed)
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeValidationError responds 422 with the per-field messages from err.
+func writeValidationError(w http.ResponseWriter, err error) {
+	var fields fieldErrors
+	if !errors.As(err, &fields) {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":  "validation failed",
+		"fields": fields,
+	}, false)
+}
+
+// peekJSONStart skips leading whitespace in rd and returns, without
+// consuming it, the first byte of the JSON value that follows.
+func peekJSONStart(rd *bufio.Reader) (byte, error) {
+	for {
+		b, err := rd.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			rd.Discard(1)
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// createBooks handles a POST whose body is a JSON array of books.
+func (s *Server) createBooks(w http.ResponseWriter, r *http.Request, body io.Reader) {
+	var raws []json.RawMessage
+	err := json.NewDecoder(body).Decode(&raws)
+	if err != nil {
+		logCtx(r.Context(), err)
+		writeDecodeError(w, err)
+		return
+	}
+	if len(raws) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "no books provided")
+		return
+	}
+	if len(raws) > maxBatchSize {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("at most %d books can be created at once", maxBatchSize))
+		return
+	}
+	books := make([]Book, len(raws))
+	for i, raw := range raws {
+		books[i], err = decodeBook(raw)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+	}
+	errs := fieldErrors{}
+	for i, book := range books {
+		var bookErrs fieldErrors
+		if errors.As(validateBookPayload(raws[i], book), &bookErrs) {
+			for name, message := range bookErrs {
+				errs[fmt.Sprintf("%d.%s", i, name)] = message
+			}
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+	ids, err := s.insertBooks(r.Context(), books)
+	if err == errDuplicateISBN {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeDBError(w, err, "could not create book")
+		return
+	}
+	s.booksChanged(eventCreated, ids...)
+	writeJSON(w, http.StatusCreated, map[string][]int{"ids": ids}, prettyJSON(r))
+}
+
+// upsertBookByISBN handles PUT on the collection: a single book body is
+// inserted, or replaces the book with the same ISBN. It answers 201 with a
+// Location for an insert and 200 for an update.
+func (s *Server) upsertBookByISBN(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&raw)
+	if err != nil {
+		logCtx(r.Context(), err)
+		writeDecodeError(w, err)
+		return
+	}
+	book, err := decodeBook(raw)
+	if err != nil {
+		logCtx(r.Context(), err)
+		writeDecodeError(w, err)
+		return
+	}
+	err = validateBookPayload(raw, book)
+	if err == nil && normalizeISBN(book.ISBN) == "" {
+		err = fieldErrors{"isbn": "is required to upsert"}
+	}
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	bookID, created, err := s.upsertBook(r.Context(), book)
+	if err != nil {
+		writeDBError(w, err, "could not upsert book")
+		return
+	}
+	if created {
+		s.booksChanged(eventCreated, bookID)
+		s.writeCreatedBook(w, r, bookID)
+		return
+	}
+	s.booksChanged(eventUpdated, bookID)
+	updated, err := s.getBook(r.Context(), bookID)
+	if err != nil || updated == nil {
+		writeDBError(w, err, "could not fetch updated book")
+		return
+	}
+	writeJSON(w, http.StatusOK, updated, prettyJSON(r))
+}
+
+// deleteBooks handles DELETE on the collection with a {"ids": [...]} body.
+func (s *Server) deleteBooks(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IDs []int `json:"ids"`
+	}
+	err := newStrictDecoder(r.Body).Decode(&body)
+	if err != nil {
+		logCtx(r.Context(), err)
+		writeDecodeError(w, err)
+		return
+	}
+	if len(body.IDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "no ids provided")
+		return
+	}
+	if len(body.IDs) > maxBatchSize {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("at most %d books can be deleted at once", maxBatchSize))
+		return
+	}
+	deleted, err := s.removeBooks(r.Context(), body.IDs)
+	if err != nil {
+		writeDBError(w, err, "could not delete books")
+		return
+	}
+	s.booksChanged(eventDeleted, deleted...)
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": len(deleted)}, prettyJSON(r))
+}
+
+// bookListEnvelope is the ?envelope=true shape of an offset-paginated list:
+// the books, or their sparse fieldsets, under data with the paging in meta.
+type bookListEnvelope struct {
+	XMLName xml.Name    `json:"-" xml:"books"`
+	Data    interface{} `json:"data" xml:"book"`
+	Meta    listMeta    `json:"meta" xml:"meta"`
+}
+
+type listMeta struct {
+	Total  int `json:"total" xml:"total"`
+	Limit  int `json:"limit" xml:"limit"`
+	Offset int `json:"offset" xml:"offset"`
+}
+
+// bookCursorPage is the list response in keyset pagination mode.
+// NextCursor is nil once there are no more books.
+type bookCursorPage struct {
+	XMLName    xml.Name `json:"-" xml:"books"`
+	Data       []Book   `json:"data" xml:"book"`
+	NextCursor *int     `json:"next_cursor" xml:"next_cursor,omitempty"`
+}
+
+// listBooksAfter writes one keyset page: up to limit books with ids above
+// afterID, in id order. It fetches one extra row to learn whether another
+// page follows.
+func (s *Server) listBooksAfter(w http.ResponseWriter, r *http.Request, filter bookFilter, afterID, limit int, fields []string) {
+	if limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be at least 1 with after")
+		return
+	}
+	total, err := s.countBooks(r.Context(), filter)
+	if err != nil {
+		writeDBError(w, err, "could not count books")
+		return
+	}
+	filter.AfterID = afterID
+	books, err := s.getBookList(r.Context(), filter, bookSort{}, limit+1, 0)
+	if err != nil {
+		writeDBError(w, err, "could not list books")
+		return
+	}
+	page := bookCursorPage{Data: books}
+	if len(books) > limit {
+		page.Data = books[:limit]
+		next := int(page.Data[limit-1].ID)
+		page.NextCursor = &next
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	var v interface{} = page
+	if fields != nil {
+		data, err := sparseBooks(page.Data, fields)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeJSONError(w, http.StatusInternalServerError, "could not encode books")
+			return
+		}
+		v = map[string]interface{}{"data": data, "next_cursor": page.NextCursor}
+	}
+	writeNegotiated(w, r, http.StatusOK, v)
+}
+
+func (s *Server) handlerBooks(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	switch r.Method {
+	case http.MethodGet:
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		order, err := parseSort(r.URL.Query().Get("sort"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filter, err := s.parseBookFilter(r)
+		if err != nil {
+			writeFilterError(w, err)
+			return
+		}
+		fields, err := parseFields(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// ?after= switches to keyset pagination, which always walks ids in
+		// ascending order; it takes precedence over offset, which is ignored
+		afterID, cursorMode, err := parseCursor(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if cursorMode {
+			if order.desc || (order.column != "" && order.column != "id") {
+				writeJSONError(w, http.StatusBadRequest, "after only supports sorting by ascending id")
+				return
+			}
+			s.listBooksAfter(w, r, filter, afterID, limit, fields)
+			return
+		}
+		page, age, cached, err := s.listCache.get(fmt.Sprintf("%+v|%+v|%d|%d", filter, order, limit, offset), func() (listPage, error) {
+			// other requests may be waiting on this fetch, so it must not
+			// fail just because this client hangs up
+			ctx := context.WithoutCancel(r.Context())
+			total, err := s.countBooks(ctx, filter)
+			if err != nil {
+				return listPage{}, err
+			}
+			var books []Book
+			if filter.Query != "" && order.column == "" {
+				// a search without an explicit sort ranks by relevance
+				books, err = s.searchBooksFullText(ctx, filter, limit, offset)
+			} else {
+				books, err = s.getBookList(ctx, filter, order, limit, offset)
+			}
+			return listPage{books: books, total: total}, err
+		})
+		if err != nil {
+			writeDBError(w, err, "could not list books")
+			return
+		}
+		BookList, total := page.books, page.total
+		if cached {
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		var v interface{} = BookList
+		if fields != nil {
+			v, err = sparseBooks(BookList, fields)
+			if err != nil {
+				logCtx(r.Context(), err)
+				writeJSONError(w, http.StatusInternalServerError, "could not encode books")
+				return
+			}
+		}
+		// the bare array stays the default so existing clients keep working
+		if r.URL.Query().Get("envelope") == "true" {
+			v = bookListEnvelope{Data: v, Meta: listMeta{Total: total, Limit: limit, Offset: offset}}
+		}
+		writeNegotiated(w, r, http.StatusOK, v)
+	case http.MethodPost:
+		body := bufio.NewReader(r.Body)
+		first, err := peekJSONStart(body)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+		key := r.Header.Get("Idempotency-Key")
+		if first == '[' {
+			if key != "" {
+				writeJSONError(w, http.StatusBadRequest, "Idempotency-Key is only supported when creating a single book")
+				return
+			}
+			s.createBooks(w, r, body)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+			return
+		}
+		if key != "" {
+			BookID, err := s.lookupIdempotencyKey(r.Context(), key)
+			if err != nil {
+				logCtx(r.Context(), err)
+				writeDBError(w, err, "could not check Idempotency-Key")
+				return
+			}
+			if BookID != 0 {
+				// a retry: answer as we did the first time
+				s.writeCreatedBook(w, r, BookID)
+				return
+			}
+		}
+		var raw json.RawMessage
+		err = json.NewDecoder(body).Decode(&raw)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+		book, err := decodeBook(raw)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+		err = validateBookPayload(raw, book)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		// a same-title book is often a data-entry slip, but not always, so
+		// warn rather than refuse; if the check fails just skip the warning
+		duplicate, _ := s.titleExists(r.Context(), book.Title)
+		BookID, err := s.insertBookIdempotent(r.Context(), book, key)
+		replayed := err == errIdempotencyKeyRace
+		if replayed {
+			// a concurrent request with the same key won; replay its result
+			BookID, err = s.lookupIdempotencyKey(r.Context(), key)
+		}
+		if err == errDuplicateISBN {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeDBError(w, err, "could not create book")
+			return
+		}
+		if !replayed {
+			s.booksChanged(eventCreated, BookID)
+			if duplicate {
+				w.Header().Set("Warning", duplicateTitleWarning)
+			}
+		}
+		s.writeCreatedBook(w, r, BookID)
+	case http.MethodPut:
+		s.upsertBookByISBN(w, r)
+	case http.MethodDelete:
+		s.deleteBooks(w, r)
+	case http.MethodOptions:
+		writePreflight(w, "GET, POST, PUT, DELETE, OPTIONS")
+	default:
+		writeMethodNotAllowed(w, "GET, POST, PUT, DELETE, OPTIONS")
+	}
+}
+
+// writeCreatedBook responds 201 with the stored book and its Location.
+// Deleted books are included so an idempotent replay still succeeds.
+func (s *Server) writeCreatedBook(w http.ResponseWriter, r *http.Request, bookID int) {
+	created, err := s.fetchBook(r.Context(), bookID, true)
+	if err != nil || created == nil {
+		writeDBError(w, err, "could not fetch created book")
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/%s/%d", apibasePath, bookPath, bookID))
+	writeJSON(w, http.StatusCreated, created, prettyJSON(r))
+}
+
+// writeUpdatedBook responds to a successful PUT or PATCH with the book as
+// it now stands, so the client sees the new version and updated_at without
+// another GET.
+func (s *Server) writeUpdatedBook(w http.ResponseWriter, r *http.Request, bookID int) {
+	updated, err := s.getBook(r.Context(), bookID)
+	if err != nil {
+		writeDBError(w, err, "could not fetch updated book")
+		return
+	}
+	if updated == nil {
+		// deleted between our update and this read
+		writeJSONError(w, http.StatusNotFound, "book not found")
+		return
+	}
+	w.Header().Set("ETag", bookETag(updated))
+	writeJSON(w, http.StatusOK, updated, prettyJSON(r))
+}
+
+// getBooksByID returns the books among bookIDs that haven't been
+// soft-deleted, in no particular order.
+func (s *Server) getBooksByID(ctx context.Context, bookIDs []int) ([]Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	args := make([]interface{}, 0, len(bookIDs))
+	for _, id := range bookIDs {
+		args = append(args, id)
+	}
+	var books []Book
+	err := s.retryDB(ctx, func() error {
+		var err error
+		books, err = s.queryBooks(ctx, `SELECT `+bookColumns+` FROM books WHERE id IN (`+placeholders(len(bookIDs))+`) AND deleted_at IS NULL`, args...)
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return books, nil
+}
+
+// batchGetResult is the response of handlerBooksBatchGet.
+type batchGetResult struct {
+	Books    []Book `json:"books"`
+	NotFound []int  `json:"not_found"`
+}
+
+// handlerBooksBatchGet looks up many books in one request. Books come back
+// in the order their ids were given, each once; ids with no book are listed
+// in not_found.
+func (s *Server) handlerBooksBatchGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "POST")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	var body struct {
+		IDs []int `json:"ids"`
+	}
+	err := newStrictDecoder(r.Body).Decode(&body)
+	if err != nil {
+		logCtx(r.Context(), err)
+		writeDecodeError(w, err)
+		return
+	}
+	if len(body.IDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "no ids provided")
+		return
+	}
+	if len(body.IDs) > maxBatchSize {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("at most %d books can be fetched at once", maxBatchSize))
+		return
+	}
+	books, err := s.getBooksByID(r.Context(), body.IDs)
+	if err != nil {
+		writeDBError(w, err, "could not fetch books")
+		return
+	}
+	byID := make(map[int]Book, len(books))
+	for _, book := range books {
+		byID[int(book.ID)] = book
+	}
+	result := batchGetResult{Books: make([]Book, 0, len(books)), NotFound: make([]int, 0)}
+	seen := make(map[int]bool, len(body.IDs))
+	for _, id := range body.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if book, ok := byID[id]; ok {
+			result.Books = append(result.Books, book)
+		} else {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+	writeJSON(w, http.StatusOK, result, prettyJSON(r))
+}
+
+// handlerBooksCount returns the number of books matching the same filters
+// the list accepts.
+func (s *Server) handlerBooksCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	filter, err := s.parseBookFilter(r)
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	count, err := s.countBooks(r.Context(), filter)
+	if err != nil {
+		writeDBError(w, err, "could not count books")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"count": count}, prettyJSON(r))
+}
+
+// listGenres returns the distinct genres of books that haven't been
+// soft-deleted, in alphabetical order. Uncategorized books are left out.
+func (s *Server) listGenres(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	genres := make([]string, 0)
+	err := s.retryDB(ctx, func() error {
+		genres = genres[:0]
+		rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT genre FROM books WHERE genre IS NOT NULL AND deleted_at IS NULL ORDER BY genre`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var genre string
+			if err := rows.Scan(&genre); err != nil {
+				return err
+			}
+			genres = append(genres, genre)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return genres, nil
+}
+
+func (s *Server) handlerBooksGenres(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	genres, err := s.listGenres(r.Context())
+	if err != nil {
+		writeDBError(w, err, "could not list genres")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"genres": genres}, prettyJSON(r))
+}
+
+// randomBook returns one book picked at random from those that haven't been
+// soft-deleted, or nil if there are none.
+func (s *Server) randomBook(ctx context.Context) (*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	random := "RAND()"
+	if s.driver == driverSQLite {
+		random = "RANDOM()"
+	}
+	book := &Book{}
+	err := s.retryDB(ctx, func() error {
+		return scanBook(s.db.QueryRowContext(ctx, `SELECT `+bookColumns+` FROM books WHERE deleted_at IS NULL ORDER BY `+random+` LIMIT 1`), book)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return book, nil
+}
+
+func (s *Server) handlerRandomBook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	book, err := s.randomBook(r.Context())
+	if err != nil {
+		writeDBError(w, err, "could not fetch a random book")
+		return
+	}
+	if book == nil {
+		writeJSONError(w, http.StatusNotFound, "there are no books")
+		return
+	}
+	writeJSON(w, http.StatusOK, book, prettyJSON(r))
+}
+
+func (s *Server) handlerBook(w http.ResponseWriter, r *http.Request) {
+	urlPathSegments := strings.Split(r.URL.Path, fmt.Sprintf("%s/", bookPath))
+	if len(urlPathSegments[1:]) > 1 {
+		writeJSONError(w, http.StatusBadRequest, "invalid book path")
+		return
+	}
+	// the id may be followed by a sub-resource, as in books/5/restore
+	idSegments := strings.SplitN(urlPathSegments[len(urlPathSegments)-1], "/", 2)
+	bookID, err := parseBookID(idSegments[0])
+	if errors.Is(err, strconv.ErrSyntax) {
+		// not a number at all, so no book can live here
+		writeJSONError(w, http.StatusNotFound, "book not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(idSegments) > 1 {
+		s.handlerBookSubresource(w, r, bookID, idSegments[1])
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		includeDeleted, err := parseIncludeDeleted(r)
+		if err != nil {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		fields, err := parseFields(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		includeRating, err := parseIncludeRating(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		book, err := s.fetchBook(r.Context(), bookID, includeDeleted)
+		if err != nil {
+			writeDBError(w, err, "could not fetch book")
+			return
+		}
+		if book == nil {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		}
+		var rating bookRating
+		etag := bookETag(book)
+		if includeRating {
+			rating, err = s.getBookRating(r.Context(), bookID)
+			if err != nil {
+				writeDBError(w, err, "could not fetch rating")
+				return
+			}
+			// a new review changes the response without touching the book
+			etag = ratedBookETag(book, rating)
+		}
+		etag = negotiatedETag(r, etag)
+		w.Header().Set("ETag", etag)
+		if match := r.Header.Get("If-None-Match"); match != "" && etagMatchesNone(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		var v interface{} = book
+		if includeRating {
+			v = ratedBook{Book: book, bookRating: rating}
+		}
+		if fields != nil {
+			selected, err := sparseBook(*book, fields)
+			if err != nil {
+				logCtx(r.Context(), err)
+				writeJSONError(w, http.StatusInternalServerError, "could not encode book")
+				return
+			}
+			if includeRating {
+				selected["average_rating"] = rating.AverageRating
+				selected["review_count"] = rating.ReviewCount
+			}
+			v = selected
+		}
+		body, err := marshalNegotiated(w, r, v)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeJSONError(w, http.StatusInternalServerError, "could not encode book")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == http.MethodHead {
+			// same headers as GET, but no body; under gzip the middleware
+			// swaps Content-Length for Content-Encoding for both
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, err = w.Write(body)
+		if err != nil {
+			logCtx(r.Context(), err)
+		}
+	case http.MethodPut:
+		var raw json.RawMessage
+		err := json.NewDecoder(r.Body).Decode(&raw)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+		book, err := decodeBook(raw)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+		// the id in the path always wins over whatever the body says
+		book.ID = BookID(bookID)
+		err = validateBookPayload(raw, book)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		match := r.Header.Get("If-Match")
+		if match != "" {
+			current, err := s.getBook(r.Context(), bookID)
+			if err != nil {
+				writeDBError(w, err, "could not fetch book")
+				return
+			}
+			matched := current != nil && matchesBookETag(match, bookETag(current))
+			if current != nil && !matched {
+				// the tag may come from GET ?include=rating, which also
+				// covers the book's current rating
+				rating, err := s.getBookRating(r.Context(), bookID)
+				if err != nil {
+					writeDBError(w, err, "could not fetch rating")
+					return
+				}
+				matched = matchesBookETag(match, ratedBookETag(current, rating))
+			}
+			if !matched {
+				writeJSONError(w, http.StatusPreconditionFailed, "book does not match If-Match, fetch it and retry")
+				return
+			}
+			if book.Version == 0 {
+				// pin the update to the version that matched, so a write
+				// landing after the check still can't be overwritten
+				book.Version = current.Version
+			}
+		}
+		err = s.updateBook(r.Context(), book)
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		} else if err == errVersionConflict && match != "" {
+			writeJSONError(w, http.StatusPreconditionFailed, "book does not match If-Match, fetch it and retry")
+			return
+		} else if err == errVersionConflict {
+			writeJSONError(w, http.StatusConflict, "book was modified by someone else, fetch it and retry")
+			return
+		} else if err == errDuplicateISBN {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			logCtx(r.Context(), err)
+			writeDBError(w, err, "could not update book")
+			return
+		}
+		s.booksChanged(eventUpdated, bookID)
+		s.writeUpdatedBook(w, r, bookID)
+	case http.MethodPatch:
+		if !isMergePatch(r) {
+			w.Header().Set("Accept-Patch", mergePatchType)
+			writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+mergePatchType)
+			return
+		}
+		var fields map[string]json.RawMessage
+		err := json.NewDecoder(r.Body).Decode(&fields)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+		if fields == nil {
+			// a merge patch that isn't an object would replace the whole
+			// book, which is what PUT is for
+			writeJSONError(w, http.StatusBadRequest, "merge patch must be a JSON object")
+			return
+		}
+		if _, ok := fields["id"]; ok {
+			writeJSONError(w, http.StatusBadRequest, "id cannot be patched")
+			return
+		}
+		for name := range fields {
+			if name != "version" && !slices.Contains(patchableFields, name) {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown field %q", name))
+				return
+			}
+		}
+		update, err := decodeBookUpdate(fields)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if update.empty() {
+			writeJSONError(w, http.StatusBadRequest, "no updatable fields provided")
+			return
+		}
+		err = update.validate()
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		version := 0
+		if raw, ok := fields["version"]; ok && !isJSONNull(raw) {
+			if json.Unmarshal(raw, &version) != nil {
+				writeJSONError(w, http.StatusBadRequest, "version must be an integer")
+				return
+			}
+		}
+		err = s.patchBook(r.Context(), bookID, update, version)
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		} else if err == errVersionConflict {
+			writeJSONError(w, http.StatusConflict, "book was modified by someone else, fetch it and retry")
+			return
+		} else if err == errDuplicateISBN {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			logCtx(r.Context(), err)
+			writeDBError(w, err, "could not update book")
+			return
+		}
+		s.booksChanged(eventUpdated, bookID)
+		s.writeUpdatedBook(w, r, bookID)
+	case http.MethodDelete:
+		err := s.removeBook(r.Context(), bookID)
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		} else if err != nil {
+			logCtx(r.Context(), err)
+			writeDBError(w, err, "could not delete book")
+			return
+		}
+		s.booksChanged(eventDeleted, bookID)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodOptions:
+		w.Header().Set("Accept-Patch", mergePatchType)
+		writePreflight(w, "GET, HEAD, PUT, PATCH, DELETE, OPTIONS")
+	default:
+		writeMethodNotAllowed(w, "GET, HEAD, PUT, PATCH, DELETE, OPTIONS")
+	}
+}
+
+// handlerBookSubresource dispatches paths below a single book, like
+// books/{id}/restore.
+func (s *Server) handlerBookSubresource(w http.ResponseWriter, r *http.Request, bookID int, subresource string) {
+	if tag, ok := strings.CutPrefix(subresource, tagsPath+"/"); ok {
+		s.handlerBookTag(w, r, bookID, tag)
+		return
+	}
+	switch subresource {
+	case "restore":
+		s.handlerRestoreBook(w, r, bookID)
+	case "reviews":
+		s.handlerBookReviews(w, r, bookID)
+	case "cover":
+		s.handlerBookCover(w, r, bookID)
+	case "similar":
+		s.handlerSimilarBooks(w, r, bookID)
+	case tagsPath:
+		s.handlerBookTags(w, r, bookID)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handlerRestoreBook undoes a soft delete and returns the restored book.
+func (s *Server) handlerRestoreBook(w http.ResponseWriter, r *http.Request, bookID int) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "POST")
+		return
+	}
+	err := s.restoreBook(r.Context(), bookID)
+	if err == errBookNotFound {
+		writeJSONError(w, http.StatusNotFound, "no deleted book with that id")
+		return
+	} else if err == errDuplicateISBN {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		logCtx(r.Context(), err)
+		writeDBError(w, err, "could not restore book")
+		return
+	}
+	s.booksChanged(eventRestored, bookID)
+	book, err := s.getBook(r.Context(), bookID)
+	if err != nil || book == nil {
+		writeDBError(w, err, "could not fetch restored book")
+		return
+	}
+	writeJSON(w, http.StatusOK, book, prettyJSON(r))
+}
+
+// handlerNotFound answers every path no other route claims, so unknown URLs
+// get the same JSON error shape as the rest of the API.
+func handlerNotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "not found")
+}
+
+// handlerHealth reports whether the process is up and the database is
+// reachable, for load balancer and kubernetes probes.
+func (s *Server) handlerHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+	err := s.db.PingContext(ctx)
+	if err != nil {
+		logCtx(r.Context(), err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"}, prettyJSON(r))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"}, prettyJSON(r))
+}
+
+func corsMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if corsAllowedOrigins == nil {
+			w.Header().Add("Access-Control-Allow-Origin", "*")
+		} else {
+			// the answer depends on Origin, so caches must key on it
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); corsAllowedOrigins[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Origin, X-Requested-With, X-API-Key, If-Match, If-None-Match, Idempotency-Key, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "Age, Content-Disposition, ETag, Location, Retry-After, Warning, X-Request-ID, X-Total-Count")
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// corsAllowedOrigins are the origins named in CORS_ALLOWED_ORIGINS. nil
+// allows any origin, without credentials.
+var corsAllowedOrigins map[string]bool
+
+// parseAllowedOrigins splits a comma-separated CORS_ALLOWED_ORIGINS value,
+// returning nil when it names no origins.
+func parseAllowedOrigins(v string) map[string]bool {
+	var origins map[string]bool
+	for _, origin := range strings.Split(v, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origins == nil {
+			origins = make(map[string]bool)
+		}
+		origins[origin] = true
+	}
+	return origins
+}
+
+// statusRecorder wraps a ResponseWriter to remember the status code and the
+// number of body bytes written, for access logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// loggingMiddleware writes one access log line per request.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.InfoContext(r.Context(), "request", "method", r.Method, "uri", r.URL.RequestURI(), "client_ip", clientIP(r), "status", rec.status,
+			"bytes", rec.size, "duration_ms", float64(time.Since(start).Microseconds())/1000)
+	})
+}
+
+// timeoutMiddleware answers 503 and cancels the request context once the
+// handler has run for requestTimeout. The response is buffered until the
+// handler returns, so streaming routes skip it.
+func timeoutMiddleware(next http.Handler) http.Handler {
+	if requestTimeout <= 0 {
+		return next
+	}
+	timeout := http.TimeoutHandler(next, requestTimeout, `{"error":"request timed out"}`)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the type of the timeout body; a handler that finishes in time
+		// sets its own
+		if r.Method != http.MethodOptions {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		timeout.ServeHTTP(w, r)
+	})
+}
+
+// apiHandler wraps an API handler in the middleware every book route shares.
+func apiHandler(handler http.HandlerFunc) http.Handler {
+	return loggingMiddleware(inflightMiddleware(gzipMiddleware(corsMiddleware(timeoutMiddleware(rateLimitMiddleware(readOnlyMiddleware(authMiddleware(handler))))))))
+}
+
+// readHandler is apiHandler for a route whose POST only reads, so it stays
+// open in read-only mode.
+func readHandler(handler http.HandlerFunc) http.Handler {
+	return loggingMiddleware(inflightMiddleware(gzipMiddleware(corsMiddleware(timeoutMiddleware(rateLimitMiddleware(readAuthMiddleware(handler)))))))
+}
+
+// streamHandler is apiHandler without the request timeout or the in-flight
+// limit, for handlers that write their response incrementally and bound
+// their own run time. A long-lived stream would hold its slot for good.
+func streamHandler(handler http.HandlerFunc) http.Handler {
+	return loggingMiddleware(gzipMiddleware(corsMiddleware(rateLimitMiddleware(readOnlyMiddleware(authMiddleware(handler))))))
+}
+
+// handle registers handler for pattern on mux, instrumented under that
+// pattern and tagged with a request id.
+func handle(mux *http.ServeMux, pattern string, handler http.Handler) {
+	mux.Handle(pattern, requestIDMiddleware(metricsMiddleware(pattern, handler)))
+}
+
+// SetupRoutes registers the server's routes on mux and returns it.
+func (s *Server) SetupRoutes(mux *http.ServeMux) *http.ServeMux {
+	handle(mux, fmt.Sprintf("%s/%s/", apibasePath, bookPath), apiHandler(s.handlerBook))
+	handle(mux, fmt.Sprintf("%s/%s", apibasePath, bookPath), apiHandler(s.handlerBooks))
+	// registered as exact paths, so they take precedence over the
+	// "/books/" prefix that handlerBook parses ids from
+	handle(mux, fmt.Sprintf("%s/%s/count", apibasePath, bookPath), apiHandler(s.handlerBooksCount))
+	handle(mux, fmt.Sprintf("%s/%s/genres", apibasePath, bookPath), apiHandler(s.handlerBooksGenres))
+	handle(mux, fmt.Sprintf("%s/%s/stats", apibasePath, bookPath), apiHandler(s.handlerStats))
+	handle(mux, fmt.Sprintf("%s/%s/import", apibasePath, bookPath), apiHandler(s.handlerBooksImport))
+	handle(mux, fmt.Sprintf("%s/%s/import/json", apibasePath, bookPath), streamHandler(s.handlerBooksImportJSON))
+	handle(mux, fmt.Sprintf("%s/%s/export", apibasePath, bookPath), streamHandler(s.handlerBooksExport))
+	handle(mux, fmt.Sprintf("%s/%s/export/json", apibasePath, bookPath), streamHandler(s.handlerBooksExportJSON))
+	handle(mux, fmt.Sprintf("%s/%s/random", apibasePath, bookPath), apiHandler(s.handlerRandomBook))
+	handle(mux, fmt.Sprintf("%s/%s/events", apibasePath, bookPath), streamHandler(s.handlerBooksEvents))
+	handle(mux, fmt.Sprintf("%s/%s/batch-get", apibasePath, bookPath), readHandler(s.handlerBooksBatchGet))
+	handle(mux, fmt.Sprintf("%s/%s/", apibasePath, authorPath), apiHandler(s.handlerAuthorBooks))
+	handle(mux, "/healthz", loggingMiddleware(http.HandlerFunc(s.handlerHealth)))
+	handle(mux, "/version", loggingMiddleware(http.HandlerFunc(handlerVersion)))
+	handle(mux, "/metrics", http.HandlerFunc(handlerMetrics))
+	handle(mux, "/openapi.json", loggingMiddleware(gzipMiddleware(http.HandlerFunc(handlerOpenAPI))))
+	// "/" matches anything, but ServeMux always prefers the longest
+	// registered pattern, so the routes above still win
+	handle(mux, "/", loggingMiddleware(http.HandlerFunc(handlerNotFound)))
+	return mux
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// databaseConfig builds the MySQL config from DATABASE_DSN if set, otherwise
+// from the discrete DB_* variables, otherwise from defaultDSN. The second
+// return value describes which source was used.
+func databaseConfig() (*mysql.Config, string, error) {
+	var cfg *mysql.Config
+	var source string
+	var err error
+	switch {
+	case os.Getenv("DATABASE_DSN") != "":
+		source = "DATABASE_DSN"
+		cfg, err = mysql.ParseDSN(os.Getenv("DATABASE_DSN"))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid DATABASE_DSN: %w", err)
+		}
+	case os.Getenv("DB_HOST") != "" || os.Getenv("DB_PORT") != "" || os.Getenv("DB_USER") != "" ||
+		os.Getenv("DB_PASS") != "" || os.Getenv("DB_NAME") != "":
+		source = "DB_* variables"
+		cfg = mysql.NewConfig()
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(envOrDefault("DB_HOST", "127.0.0.1"), envOrDefault("DB_PORT", "3306"))
+		cfg.User = envOrDefault("DB_USER", "root")
+		cfg.Passwd = os.Getenv("DB_PASS")
+		cfg.DBName = envOrDefault("DB_NAME", "bookdb")
+	default:
+		source = "built-in default"
+		cfg, err = mysql.ParseDSN(defaultDSN)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	// clientFoundRows makes RowsAffected report matched rows, so an UPDATE
+	// that doesn't change anything isn't mistaken for a missing book
+	cfg.ClientFoundRows = true
+	// parseTime scans DATETIME columns straight into time.Time
+	cfg.ParseTime = true
+	return cfg, source, nil
+}
+
+// waitForDB pings the database until it answers, backing off exponentially
+// between attempts, and gives up once dbConnectTimeout has passed.
+func (s *Server) waitForDB() error {
+	deadline := time.Now().Add(dbConnectTimeout)
+	backoff := dbConnectInitialBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		err := s.db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("database unreachable after %d attempts: %w", attempt, err)
+		}
+		logger.Warn("database not ready", "attempt", attempt, "error", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > dbConnectMaxBackoff {
+			backoff = dbConnectMaxBackoff
+		}
+	}
+}
+
+// envInt returns the integer in the environment variable name, or def when
+// it is unset. Negative values are rejected.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", name, v)
+	}
+	return n, nil
+}
+
+// configurePool applies DB_MAX_OPEN, DB_MAX_IDLE and DB_CONN_MAX_LIFETIME to
+// the server's database, falling back to the given defaults. Zero keeps database/sql's meaning:
+// unlimited open connections, no idle connections, no lifetime limit.
+func (s *Server) configurePool(defaultOpen, defaultIdle int) error {
+	maxOpen, err := envInt("DB_MAX_OPEN", defaultOpen)
+	if err != nil {
+		return err
+	}
+	maxIdle, err := envInt("DB_MAX_IDLE", defaultIdle)
+	if err != nil {
+		return err
+	}
+	lifetime := defaultDBConnMaxLifetime
+	if v := os.Getenv("DB_CONN_MAX_LIFETIME"); v != "" {
+		lifetime, err = time.ParseDuration(v)
+		if err != nil || lifetime < 0 {
+			return fmt.Errorf("invalid DB_CONN_MAX_LIFETIME %q: must be a duration such as 3m", v)
+		}
+	}
+	if maxOpen > 0 && maxIdle > maxOpen {
+		// database/sql silently lowers max idle to max open
+		logger.Warn("DB_MAX_IDLE is greater than DB_MAX_OPEN, only DB_MAX_OPEN idle connections will be kept", "max_idle", maxIdle, "max_open", maxOpen)
+	}
+	s.db.SetMaxOpenConns(maxOpen)
+	s.db.SetMaxIdleConns(maxIdle)
+	s.db.SetConnMaxLifetime(lifetime)
+	logger.Info("database pool", "max_open", maxOpen, "max_idle", maxIdle, "max_lifetime", lifetime)
+	return nil
+}
+
+func (s *Server) SetupDB() error {
+	s.driver = envOrDefault("DB_DRIVER", driverMySQL)
+	maxOpen, maxIdle := defaultDBMaxOpen, defaultDBMaxIdle
+	var err error
+	switch s.driver {
+	case driverMySQL:
+		cfg, source, err := databaseConfig()
+		if err != nil {
+			return err
+		}
+		logger.Info("connecting to MySQL", "user", cfg.User, "addr", cfg.Addr, "database", cfg.DBName, "config_from", source)
+		s.db, err = sql.Open("mysql", cfg.FormatDSN())
+		if err != nil {
+			return err
+		}
+	case driverSQLite:
+		dsn := envOrDefault("DATABASE_DSN", defaultSQLiteDSN)
+		logger.Info("opening SQLite database", "dsn", dsn)
+		// modernc.org/sqlite registers itself as "sqlite"
+		s.db, err = sql.Open("sqlite", dsn)
+		if err != nil {
+			return err
+		}
+		// SQLite allows a single writer; one connection avoids
+		// "database is locked" errors between our own goroutines
+		maxOpen, maxIdle = 1, 1
+	default:
+		return fmt.Errorf("unsupported DB_DRIVER %q: use %q or %q", s.driver, driverMySQL, driverSQLite)
+	}
+	err = s.configurePool(maxOpen, maxIdle)
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	err = s.waitForDB()
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	err = s.migrate()
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	err = s.prepareStatements()
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	s.fullText, err = s.hasFullTextIndex(ctx)
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	if !s.fullText {
+		logger.Info("no FULLTEXT index on books, ?q= falls back to substring matching")
+	}
+	logger.Info("database connection established")
+	return nil
+}
+
+// listenPort returns the port from the PORT environment variable, or
+// defaultPort when it is unset.
+func listenPort() (string, error) {
+	port := os.Getenv("PORT")
+	if port == "" {
+		return defaultPort, nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid PORT %q: must be an integer between 1 and 65535", port)
+	}
+	return port, nil
+}
+
+// listenAddr returns the address to listen on: BIND_ADDR, such as
+// "127.0.0.1:5000" to accept only local connections, or else every
+// interface on listenPort. BIND_ADDR wins when PORT is set too.
+func listenAddr() (string, error) {
+	addr := os.Getenv("BIND_ADDR")
+	if addr == "" {
+		port, err := listenPort()
+		if err != nil {
+			return "", err
+		}
+		return ":" + port, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid BIND_ADDR %q: must be host:port or :port", addr)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid BIND_ADDR %q: port must be an integer between 1 and 65535", addr)
+	}
+	if os.Getenv("PORT") != "" {
+		logger.Info("BIND_ADDR is set, ignoring PORT", "bind_addr", addr)
+	}
+	return addr, nil
+}
+
+func main() {
+	seed := flag.Bool("seed", false, "insert sample books into an empty catalog and exit")
+	flag.Parse()
+	level, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		fatal(err.Error())
+	}
+	logger = newLogger(os.Stderr, level)
+	// anything still using the log package ends up in the same stream
+	slog.SetDefault(logger)
+	logger.Info("starting gobasic", "version", version, "commit", commit, "built_at", buildTime)
+
+	addr, err := listenAddr()
+	if err != nil {
+		fatal(err.Error())
+	}
+	if v := os.Getenv("MAX_BODY_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			fatal("invalid MAX_BODY_BYTES: must be a positive integer", "value", v)
+		}
+		maxBodyBytes = n
+	}
+	if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			fatal("invalid REQUEST_TIMEOUT: must be a duration such as 10s", "value", v)
+		}
+		requestTimeout = d
+	}
+	if v := os.Getenv("SLOW_QUERY_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			fatal("invalid SLOW_QUERY_THRESHOLD: must be a duration such as 500ms", "value", v)
+		}
+		slowQueryThreshold = d
+	}
+	listCacheTTL := defaultListCacheTTL
+	if v := os.Getenv("LIST_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			fatal("invalid LIST_CACHE_TTL: must be a duration such as 30s", "value", v)
+		}
+		listCacheTTL = d
+	}
+
+	rate, err := strconv.ParseFloat(envOrDefault("RATE_LIMIT_RPS", defaultRateLimitRPS), 64)
+	if err != nil || rate < 0 {
+		fatal("invalid RATE_LIMIT_RPS: must be a non-negative number", "value", os.Getenv("RATE_LIMIT_RPS"))
+	}
+	burst, err := strconv.Atoi(envOrDefault("RATE_LIMIT_BURST", defaultRateLimitBurst))
+	if err != nil || burst < 1 {
+		fatal("invalid RATE_LIMIT_BURST: must be a positive integer", "value", os.Getenv("RATE_LIMIT_BURST"))
+	}
+	trustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		fatal(err.Error())
+	}
+	if trustedProxies == nil && os.Getenv("BEHIND_PROXY") == "true" {
+		// the older setting believed X-Forwarded-For from anyone
+		_, any4, _ := net.ParseCIDR("0.0.0.0/0")
+		_, any6, _ := net.ParseCIDR("::/0")
+		trustedProxies = []*net.IPNet{any4, any6}
+		logger.Warn("BEHIND_PROXY trusts X-Forwarded-For from any address, set TRUSTED_PROXIES to the proxies' networks instead")
+	} else if trustedProxies != nil {
+		logger.Info("honoring forwarded client addresses from trusted proxies", "networks", len(trustedProxies))
+	}
+	if rate == 0 {
+		logger.Info("rate limiting disabled")
+	} else {
+		limiter = newRateLimiter(rate, burst)
+		go limiter.cleanup(time.Minute)
+		logger.Info("rate limiting per client", "requests_per_second", rate, "burst", burst)
+	}
+
+	corsAllowedOrigins = parseAllowedOrigins(os.Getenv("CORS_ALLOWED_ORIGINS"))
+	if corsAllowedOrigins == nil {
+		logger.Info("CORS_ALLOWED_ORIGINS is not set, allowing any origin")
+	} else {
+		logger.Info("allowing cross-origin requests", "origins", len(corsAllowedOrigins))
+	}
+
+	maxInflight, err := envInt("MAX_INFLIGHT", 0)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if maxInflight > 0 {
+		inflight = make(chan struct{}, maxInflight)
+		logger.Info("limiting in-flight requests", "max_inflight", maxInflight)
+	}
+
+	maxPageLimit, err = envInt("MAX_PAGE_SIZE", maxPageLimit)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if maxPageLimit < 1 {
+		fatal("invalid MAX_PAGE_SIZE: must be at least 1", "value", maxPageLimit)
+	}
+	defaultPageLimit, err = envInt("DEFAULT_PAGE_SIZE", defaultPageLimit)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if defaultPageLimit < 1 {
+		fatal("invalid DEFAULT_PAGE_SIZE: must be at least 1", "value", defaultPageLimit)
+	}
+	if defaultPageLimit > maxPageLimit {
+		logger.Warn("DEFAULT_PAGE_SIZE is greater than MAX_PAGE_SIZE, using MAX_PAGE_SIZE", "default_page_size", defaultPageLimit, "max_page_size", maxPageLimit)
+		defaultPageLimit = maxPageLimit
+	}
+
+	normalizeAuthors, titleCaseAuthors, err = parseNormalizeAuthors(os.Getenv("NORMALIZE_AUTHORS"))
+	if err != nil {
+		fatal(err.Error())
+	}
+	if normalizeAuthors {
+		logger.Info("normalizing author names", "title_case", titleCaseAuthors)
+	}
+
+	readOnly = os.Getenv("READ_ONLY") == "true"
+	if readOnly {
+		logger.Info("read-only mode is active, writes will be rejected")
+	}
+
+	apiKey = os.Getenv("API_KEY")
+	authReads = os.Getenv("API_KEY_PROTECT_READS") == "true"
+	if apiKey == "" {
+		logger.Warn("API_KEY is not set, authentication is disabled")
+	} else if authReads {
+		logger.Info("API key required for all requests")
+	} else {
+		logger.Info("API key required for POST, PUT, PATCH and DELETE")
+	}
+
+	s, err := NewServer()
+	if err != nil {
+		fatal("database setup failed", "error", err)
+	}
+	s.listCache = newListCache(listCacheTTL)
+	if s.listCache == nil {
+		logger.Info("list caching disabled")
+	} else {
+		logger.Info("caching book list pages", "ttl", listCacheTTL)
+	}
+	if *seed {
+		err = s.seedBooks()
+		s.db.Close()
+		if err != nil {
+			fatal("seeding failed", "error", err)
+		}
+		return
+	}
+	mux := s.SetupRoutes(http.NewServeMux())
+
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	server := &http.Server{Addr: addr, Handler: mux, ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError)}
+	// Shutdown waits for open connections, so end the event streams first
+	server.RegisterOnShutdown(s.events.close)
+	go func() {
+		var err error
+		if certFile != "" {
+			logger.Info("listening", "addr", server.Addr, "tls", true)
+			err = server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			logger.Info("listening", "addr", server.Addr, "tls", false)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("server failed", "error", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	logger.Info("shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		logger.Error("server shutdown", "error", err)
+	} else {
+		logger.Info("http server stopped")
+	}
+	err = s.db.Close()
+	if err != nil {
+		logger.Error("closing database", "error", err)
+	} else {
+		logger.Info("database closed")
+	}
+}
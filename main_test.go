@@ -0,0 +1,790 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMain(m *testing.M) {
+	// handlers log every failure; tests provoke plenty of them on purpose
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// newMockServer returns a Server backed by sqlmock with its statements
+// already prepared, the mock to set expectations on, and the server's
+// routes. Expectations must be met in the order they are set.
+func newMockServer(t *testing.T) (*Server, sqlmock.Sqlmock, http.Handler) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s := &Server{db: db, driver: driverMySQL, events: &eventHub{}}
+	mock.ExpectPrepare(`SELECT .+ FROM books WHERE id = \? AND deleted_at IS NULL`)
+	mock.ExpectPrepare(`SELECT .+ FROM books WHERE id = \?$`)
+	mock.ExpectPrepare(`INSERT INTO books`)
+	if err := s.prepareStatements(); err != nil {
+		t.Fatal(err)
+	}
+	return s, mock, s.SetupRoutes(http.NewServeMux())
+}
+
+// newSQLiteServer returns a Server on a fresh SQLite database in a
+// temporary directory, migrated to the current schema.
+func newSQLiteServer(t testing.TB) *Server {
+	t.Helper()
+	return openSQLiteServer(t, sqliteDSN(t))
+}
+
+// sqliteDSN names a new SQLite database in a temporary directory.
+func sqliteDSN(t testing.TB) string {
+	return "file:" + t.TempDir() + "/books.db?_pragma=busy_timeout(5000)&_time_format=sqlite"
+}
+
+// openSQLiteServer returns a Server on the SQLite database dsn, migrated to
+// the current schema.
+func openSQLiteServer(t testing.TB, dsn string) *Server {
+	t.Helper()
+	t.Setenv("DB_DRIVER", driverSQLite)
+	t.Setenv("DATABASE_DSN", dsn)
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+	return s
+}
+
+// serve sends one request through h and returns what it wrote.
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// checkExpectations fails t if the handler skipped any expected query.
+func checkExpectations(t *testing.T, mock sqlmock.Sqlmock) {
+	t.Helper()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// errorMessage returns the message of a {"error": ...} body.
+func errorMessage(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not a JSON error: %v", w.Body.String(), err)
+	}
+	return body.Error
+}
+
+var testTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// bookRows returns rows in bookColumns order holding a live book for each
+// of titles, numbered from 1.
+func bookRows(titles ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows(strings.Split(bookColumns, ", "))
+	for i, title := range titles {
+		rows.AddRow(i+1, title, "Author", nil, nil, nil, nil, 1, testTime, testTime, nil)
+	}
+	return rows
+}
+
+// expectBookTags expects the query for a book's tags and answers tags.
+func expectBookTags(mock sqlmock.Sqlmock, tags ...string) {
+	rows := sqlmock.NewRows([]string{"name"})
+	for _, tag := range tags {
+		rows.AddRow(tag)
+	}
+	mock.ExpectQuery(`SELECT t.name FROM book_tags`).WillReturnRows(rows)
+}
+
+func TestListBooks(t *testing.T) {
+	_, mock, h := newMockServer(t)
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM books WHERE deleted_at IS NULL`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(`SELECT .+ FROM books WHERE deleted_at IS NULL .*LIMIT \? OFFSET \?`).
+		WithArgs(defaultPageLimit, 0).
+		WillReturnRows(bookRows("Dune", "Emma"))
+
+	w := serve(h, http.MethodGet, "/api/books", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got := w.Header().Get("X-Total-Count"); got != "2" {
+		t.Errorf("X-Total-Count = %q, want 2", got)
+	}
+	var books []Book
+	if err := json.Unmarshal(w.Body.Bytes(), &books); err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 || books[0].Title != "Dune" || books[1].Title != "Emma" {
+		t.Errorf("books = %+v, want Dune and Emma", books)
+	}
+	checkExpectations(t, mock)
+}
+
+func TestListBooksDBError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		message string
+	}{
+		{"failure", io.ErrClosedPipe, http.StatusInternalServerError, "could not list books"},
+		{"timeout", context.DeadlineExceeded, http.StatusGatewayTimeout, "database timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mock, h := newMockServer(t)
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM books`).WillReturnError(tt.err)
+
+			w := serve(h, http.MethodGet, "/api/books", "")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+			}
+			if got := errorMessage(t, w); got != tt.message {
+				t.Errorf("error = %q, want %q", got, tt.message)
+			}
+			checkExpectations(t, mock)
+		})
+	}
+}
+
+func TestGetBook(t *testing.T) {
+	_, mock, h := newMockServer(t)
+	mock.ExpectQuery(`SELECT .+ FROM books WHERE id = \? AND deleted_at IS NULL`).
+		WithArgs(1).
+		WillReturnRows(bookRows("Dune"))
+	expectBookTags(mock, "classic")
+
+	w := serve(h, http.MethodGet, "/api/books/1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusOK, w.Body)
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Error("no ETag")
+	}
+	var book Book
+	if err := json.Unmarshal(w.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.ID != 1 || book.Title != "Dune" || len(book.Tags) != 1 || book.Tags[0] != "classic" {
+		t.Errorf("book = %+v, want book 1, Dune, tagged classic", book)
+	}
+	checkExpectations(t, mock)
+}
+
+func TestGetBookNotFound(t *testing.T) {
+	_, mock, h := newMockServer(t)
+	mock.ExpectQuery(`SELECT .+ FROM books WHERE id = \? AND deleted_at IS NULL`).
+		WithArgs(42).
+		WillReturnRows(bookRows())
+
+	w := serve(h, http.MethodGet, "/api/books/42", "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusNotFound, w.Body)
+	}
+	if got := errorMessage(t, w); got != "book not found" {
+		t.Errorf("error = %q, want %q", got, "book not found")
+	}
+	checkExpectations(t, mock)
+}
+
+func TestCreateBook(t *testing.T) {
+	_, mock, h := newMockServer(t)
+	mock.ExpectQuery(`SELECT 1 FROM books WHERE LOWER\(title\) = LOWER\(\?\)`).
+		WithArgs("Dune").
+		WillReturnRows(sqlmock.NewRows([]string{"1"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO books`).
+		WithArgs("Dune", "Author", nil, nil, nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT .+ FROM books WHERE id = \?$`).
+		WithArgs(1).
+		WillReturnRows(bookRows("Dune"))
+	expectBookTags(mock)
+
+	w := serve(h, http.MethodPost, "/api/books", `{"title": "Dune", "author": "Author"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if got := w.Header().Get("Location"); got != "/api/books/1" {
+		t.Errorf("Location = %q, want /api/books/1", got)
+	}
+	var book Book
+	if err := json.Unmarshal(w.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.ID != 1 || book.Title != "Dune" {
+		t.Errorf("book = %+v, want book 1, Dune", book)
+	}
+	checkExpectations(t, mock)
+}
+
+func TestCreateBookDBError(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		bulk   bool
+		err    error
+		status int
+	}{
+		{"one", `{"title": "Dune", "author": "Author"}`, false, io.ErrClosedPipe, http.StatusInternalServerError},
+		{"many", `[{"title": "Dune", "author": "Author"}, {"title": "Emma", "author": "Author"}]`, true, io.ErrClosedPipe, http.StatusInternalServerError},
+		{"timeout", `{"title": "Dune", "author": "Author"}`, false, context.DeadlineExceeded, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mock, h := newMockServer(t)
+			if !tt.bulk {
+				// only a single create warns about a duplicate title
+				mock.ExpectQuery(`SELECT 1 FROM books WHERE LOWER\(title\) = LOWER\(\?\)`).
+					WillReturnRows(sqlmock.NewRows([]string{"1"}))
+			}
+			mock.ExpectBegin()
+			mock.ExpectExec(`INSERT INTO books`).WillReturnError(tt.err)
+			mock.ExpectRollback()
+
+			w := serve(h, http.MethodPost, "/api/books", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusInternalServerError {
+				if got := errorMessage(t, w); got != "could not create book" {
+					t.Errorf("error = %q, want %q", got, "could not create book")
+				}
+			}
+			checkExpectations(t, mock)
+		})
+	}
+}
+
+func TestCreateBookBadJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"truncated", `{"title": "Dune"`},
+		{"not JSON", `title=Dune`},
+		{"wrong type", `{"title": 5, "author": "Author"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mock, h := newMockServer(t)
+
+			w := serve(h, http.MethodPost, "/api/books", tt.body)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+			errorMessage(t, w)
+			// nothing may reach the database
+			checkExpectations(t, mock)
+		})
+	}
+}
+
+func TestDeleteBook(t *testing.T) {
+	tests := []struct {
+		name   string
+		rows   int64
+		status int
+	}{
+		{"deleted", 1, http.StatusNoContent},
+		{"missing", 0, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mock, h := newMockServer(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(`UPDATE books SET\s+deleted_at = \?,\s+version = version \+ 1,\s+updated_at = \?\s+WHERE id = \? AND deleted_at IS NULL`).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 7).
+				WillReturnResult(sqlmock.NewResult(0, tt.rows))
+			mock.ExpectCommit()
+
+			w := serve(h, http.MethodDelete, "/api/books/7", "")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body)
+			}
+			checkExpectations(t, mock)
+		})
+	}
+}
+
+func TestDeleteBookDBError(t *testing.T) {
+	_, mock, h := newMockServer(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE books SET`).WillReturnError(io.ErrClosedPipe)
+	mock.ExpectRollback()
+
+	w := serve(h, http.MethodDelete, "/api/books/7", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusInternalServerError, w.Body)
+	}
+	if got := errorMessage(t, w); got != "could not delete book" {
+		t.Errorf("error = %q, want %q", got, "could not delete book")
+	}
+	checkExpectations(t, mock)
+}
+
+func TestSoftDeleteBumpsVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(s *Server, ctx context.Context, id int) error
+	}{
+		{"one", func(s *Server, ctx context.Context, id int) error {
+			return s.removeBook(ctx, id)
+		}},
+		{"many", func(s *Server, ctx context.Context, id int) error {
+			_, err := s.removeBooks(ctx, []int{id})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSQLiteServer(t)
+			ctx := context.Background()
+			id, err := s.insertBook(ctx, Book{Title: "Dune", Author: "Frank Herbert"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := s.getBook(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.remove(s, ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := s.fetchBook(ctx, id, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.DeletedAt == nil {
+				t.Fatal("DeletedAt = nil, want it set")
+			}
+			if after.Version != before.Version+1 {
+				t.Errorf("Version = %d, want %d", after.Version, before.Version+1)
+			}
+			if !after.UpdatedAt.Equal(*after.DeletedAt) {
+				t.Errorf("UpdatedAt = %v, want the deletion time %v", after.UpdatedAt, *after.DeletedAt)
+			}
+			if bookETag(after) == bookETag(before) {
+				t.Error("ETag unchanged by the delete")
+			}
+		})
+	}
+}
+
+func TestReadsIgnoreExtraColumns(t *testing.T) {
+	s := newSQLiteServer(t)
+	ctx := context.Background()
+	// a column the code doesn't select must not upset what the reads scan,
+	// as it did back when they used SELECT *
+	_, err := s.db.ExecContext(ctx, `ALTER TABLE books ADD COLUMN shelf VARCHAR(32) NOT NULL DEFAULT 'A1'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Book{Title: "Dune", Author: "Frank Herbert", ISBN: "9780441172719", Year: 1965, Genre: "science fiction", PriceCents: 1099}
+	id, err := s.insertBook(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the prepared statements were prepared before the column existed
+	if err := s.prepareStatements(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		read func() (*Book, error)
+	}{
+		{"getBook", func() (*Book, error) { return s.getBook(ctx, id) }},
+		{"fetchBook with deleted", func() (*Book, error) { return s.fetchBook(ctx, id, true) }},
+		{"getBookList", func() (*Book, error) {
+			books, err := s.getBookList(ctx, bookFilter{}, bookSort{}, 10, 0)
+			if err != nil || len(books) != 1 {
+				return nil, err
+			}
+			return &books[0], nil
+		}},
+		{"getBooksByID", func() (*Book, error) {
+			books, err := s.getBooksByID(ctx, []int{id})
+			if err != nil || len(books) != 1 {
+				return nil, err
+			}
+			return &books[0], nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil {
+				t.Fatal("book not found")
+			}
+			if int(got.ID) != id || got.Title != want.Title || got.Author != want.Author || got.ISBN != want.ISBN ||
+				got.Year != want.Year || got.Genre != want.Genre || got.PriceCents != want.PriceCents || got.Version != 1 {
+				t.Errorf("got %+v, want %+v with id %d", *got, want, id)
+			}
+		})
+	}
+}
+
+func TestInsertAssignsDistinctIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		insert func(s *Server, books []Book) ([]int, error)
+	}{
+		{"one at a time", func(s *Server, books []Book) ([]int, error) {
+			var ids []int
+			for _, book := range books {
+				id, err := s.insertBook(context.Background(), book)
+				if err != nil {
+					return nil, err
+				}
+				ids = append(ids, id)
+			}
+			return ids, nil
+		}},
+		{"in bulk", func(s *Server, books []Book) ([]int, error) {
+			return s.insertBooks(context.Background(), books)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSQLiteServer(t)
+			// ids from the client are ignored, even when they collide
+			books := []Book{
+				{ID: 5, Title: "Dune", Author: "Frank Herbert"},
+				{ID: 5, Title: "Emma", Author: "Jane Austen"},
+				{Title: "Ulysses", Author: "James Joyce"},
+			}
+			ids, err := tt.insert(s, books)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != len(books) {
+				t.Fatalf("got %d ids for %d books", len(ids), len(books))
+			}
+			seen := make(map[int]bool)
+			for i, id := range ids {
+				if id <= 0 || seen[id] {
+					t.Errorf("ids = %v, want distinct positive ids", ids)
+					break
+				}
+				seen[id] = true
+				book, err := s.getBook(context.Background(), id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if book == nil || book.Title != books[i].Title {
+					t.Errorf("book %d = %+v, want %q", id, book, books[i].Title)
+				}
+			}
+		})
+	}
+}
+
+func TestFailedTransactionWritesNothing(t *testing.T) {
+	errForced := errors.New("forced failure")
+	tests := []struct {
+		name  string
+		write func(s *Server) error
+		want  error
+	}{
+		{"bulk insert with a duplicate ISBN", func(s *Server) error {
+			_, err := s.insertBooks(context.Background(), []Book{
+				{Title: "Dune", Author: "Frank Herbert", ISBN: "9780441172719"},
+				{Title: "Emma", Author: "Jane Austen"},
+				{Title: "Dune again", Author: "Frank Herbert", ISBN: "9780441172719"},
+			})
+			return err
+		}, errDuplicateISBN},
+		{"error after a write", func(s *Server) error {
+			ctx := context.Background()
+			return s.withTx(ctx, func(tx *sql.Tx) error {
+				_, err := s.execInsertBook(ctx, tx, Book{Title: "Dune", Author: "Frank Herbert"})
+				if err != nil {
+					return err
+				}
+				return errForced
+			})
+		}, errForced},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSQLiteServer(t)
+			err := tt.write(s)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			count, err := s.countBooks(context.Background(), bookFilter{IncludeDeleted: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Errorf("%d books written, want none", count)
+			}
+		})
+	}
+}
+
+func TestFailedTransactionRollsBack(t *testing.T) {
+	s, mock, _ := newMockServer(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO books`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO books`).WillReturnError(io.ErrClosedPipe)
+	mock.ExpectRollback()
+
+	_, err := s.insertBooks(context.Background(), []Book{{Title: "Dune", Author: "Frank Herbert"}, {Title: "Emma", Author: "Jane Austen"}})
+	if err == nil {
+		t.Fatal("insertBooks succeeded, want an error")
+	}
+	checkExpectations(t, mock)
+}
+
+func TestValidateBookYear(t *testing.T) {
+	maxYear := time.Now().Year() + 1
+	tests := []struct {
+		year  int
+		valid bool
+	}{
+		{0, true}, // unknown
+		{minBookYear - 1, false},
+		{minBookYear, true},
+		{maxYear, true},
+		{maxYear + 1, false},
+		{-1, false},
+	}
+	for _, tt := range tests {
+		err := validateBook(Book{Title: "Dune", Author: "Frank Herbert", Year: tt.year})
+		var errs fieldErrors
+		invalid := errors.As(err, &errs) && errs["year"] != ""
+		if invalid == tt.valid {
+			t.Errorf("validateBook with year %d: err = %v, want valid = %v", tt.year, err, tt.valid)
+		}
+	}
+}
+
+func TestYearRangeFilter(t *testing.T) {
+	s := newSQLiteServer(t)
+	ctx := context.Background()
+	maxYear := time.Now().Year() + 1
+	_, err := s.insertBooks(ctx, []Book{
+		{Title: "Oldest", Author: "A", Year: minBookYear},
+		{Title: "Middle", Author: "A", Year: 1900},
+		{Title: "Newest", Author: "A", Year: maxYear},
+		{Title: "Undated", Author: "A"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  []string // titles in id order, or nil for a 400
+	}{
+		{"year_min=1400&year_max=1400", []string{"Oldest"}},
+		{"year_min=1401", []string{"Middle", "Newest"}},
+		{"year_max=1900", []string{"Oldest", "Middle"}},
+		{fmt.Sprintf("year_min=%d&year_max=%d", maxYear, maxYear), []string{"Newest"}},
+		{"year_min=1900&year_max=1900", []string{"Middle"}},
+		{"year_min=1901&year_max=1900", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			filter, err := s.parseBookFilter(httptest.NewRequest(http.MethodGet, "/api/books?"+tt.query, nil))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("filter = %+v, want an error", filter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			books, err := s.getBookList(ctx, filter, bookSort{}, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, book := range books {
+				got = append(got, book.Title)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("titles = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOversizedBody(t *testing.T) {
+	defer func(n int64) { maxBodyBytes = n }(maxBodyBytes)
+	maxBodyBytes = 64
+	big := `{"title": "` + strings.Repeat("x", 100) + `", "author": "Author"}`
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+	}{
+		{"create", http.MethodPost, "/api/books", "application/json", big},
+		{"bulk create", http.MethodPost, "/api/books", "application/json", "[" + big + "]"},
+		{"replace", http.MethodPut, "/api/books/1", "application/json", big},
+		{"patch", http.MethodPatch, "/api/books/1", mergePatchType, big},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mock, h := newMockServer(t)
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusRequestEntityTooLarge, w.Body)
+			}
+			if got, want := errorMessage(t, w), "request body must be at most 64 bytes"; got != want {
+				t.Errorf("error = %q, want %q", got, want)
+			}
+			checkExpectations(t, mock)
+		})
+	}
+}
+
+func TestUnknownField(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+	}{
+		{"create", http.MethodPost, "/api/books", "application/json", `{"titel": "Dune", "author": "Frank Herbert"}`},
+		{"bulk create", http.MethodPost, "/api/books", "application/json", `[{"title": "Emma", "author": "Jane Austen"}, {"titel": "Dune", "author": "Frank Herbert"}]`},
+		{"replace", http.MethodPut, "/api/books/1", "application/json", `{"titel": "Dune", "author": "Frank Herbert"}`},
+		{"patch", http.MethodPatch, "/api/books/1", mergePatchType, `{"titel": "Dune"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mock, h := newMockServer(t)
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+			if got := errorMessage(t, w); !strings.Contains(got, `unknown field "titel"`) {
+				t.Errorf("error = %q, want it to name the field titel", got)
+			}
+			checkExpectations(t, mock)
+		})
+	}
+}
+
+func TestWriteDecodeError(t *testing.T) {
+	decode := func(body string) error {
+		var book Book
+		return newStrictDecoder(strings.NewReader(body)).Decode(&book)
+	}
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		message string
+	}{
+		{"unknown field", decode(`{"titel": "Dune"}`), http.StatusBadRequest, `unknown field "titel"`},
+		{"syntax", decode(`{"title": `), http.StatusBadRequest, "invalid JSON body"},
+		{"wrong type", decode(`{"year": "1965"}`), http.StatusBadRequest, "invalid JSON body"},
+		{"bad id", decode(`{"id": "five"}`), http.StatusBadRequest, errInvalidID.Error()},
+		{"price as number", decode(`{"price": 10.99}`), http.StatusUnprocessableEntity, "validation failed"},
+		{"too large", &http.MaxBytesError{Limit: 10}, http.StatusRequestEntityTooLarge, "request body must be at most 10 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err == nil {
+				t.Fatal("decoding succeeded, want an error")
+			}
+			w := httptest.NewRecorder()
+			writeDecodeError(w, tt.err)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := errorMessage(t, w); got != tt.message {
+				t.Errorf("error = %q, want %q", got, tt.message)
+			}
+		})
+	}
+}
+
+func TestHeadBook(t *testing.T) {
+	s := newSQLiteServer(t)
+	h := s.SetupRoutes(http.NewServeMux())
+	_, err := s.insertBook(context.Background(), Book{Title: "Dune", Author: "Frank Herbert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		encoding       string
+	}{
+		{"identity", "", ""},
+		{"gzip", "gzip", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send := func(method string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(method, "/api/books/1", nil)
+				if tt.acceptEncoding != "" {
+					r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				return w
+			}
+			get, head := send(http.MethodGet), send(http.MethodHead)
+			if head.Code != http.StatusOK {
+				t.Fatalf("HEAD status = %d, want %d", head.Code, http.StatusOK)
+			}
+			if head.Body.Len() != 0 {
+				t.Errorf("HEAD body = %q, want none", head.Body)
+			}
+			if got := head.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("HEAD Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			for _, name := range []string{"Content-Type", "Content-Length", "Content-Encoding", "ETag", "Vary"} {
+				if got, want := head.Header().Values(name), get.Header().Values(name); strings.Join(got, ", ") != strings.Join(want, ", ") {
+					t.Errorf("HEAD %s = %q, GET sent %q", name, got, want)
+				}
+			}
+		})
+	}
+}
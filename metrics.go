@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration
+// histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// knownMethods keeps the method label low-cardinality; anything else is
+// reported as "OTHER".
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+type requestKey struct {
+	route, method, status string
+}
+
+type latencyKey struct {
+	route, method string
+}
+
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// requestMetrics is a minimal Prometheus-style registry for the two metrics
+// the server exports.
+type requestMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[latencyKey]*histogram
+}
+
+var metrics = &requestMetrics{
+	requests:  make(map[requestKey]uint64),
+	latencies: make(map[latencyKey]*histogram),
+}
+
+func (m *requestMetrics) observe(route, method string, status int, duration time.Duration) {
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	seconds := duration.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route, method, fmt.Sprintf("%dxx", status/100)}]++
+	h, ok := m.latencies[latencyKey{route, method}]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.latencies[latencyKey{route, method}] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// writeTo renders the registry in the Prometheus text exposition format.
+func (m *requestMetrics) writeTo(w *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	fmt.Fprintln(w, "# HELP http_requests_total Total HTTP requests by route, method and status class.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, key := range requestKeys {
+		fmt.Fprintf(w, "http_requests_total{route=%q,method=%q,status=%q} %d\n",
+			key.route, key.method, key.status, m.requests[key])
+	}
+
+	latencyKeys := make([]latencyKey, 0, len(m.latencies))
+	for key := range m.latencies {
+		latencyKeys = append(latencyKeys, key)
+	}
+	sort.Slice(latencyKeys, func(i, j int) bool {
+		a, b := latencyKeys[i], latencyKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.method < b.method
+	})
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds HTTP request latency by route and method.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, key := range latencyKeys {
+		h := m.latencies[key]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{route=%q,method=%q,le=\"%g\"} %d\n",
+				key.route, key.method, bound, h.buckets[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{route=%q,method=%q,le=\"+Inf\"} %d\n",
+			key.route, key.method, h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{route=%q,method=%q} %g\n", key.route, key.method, h.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{route=%q,method=%q} %d\n", key.route, key.method, h.count)
+	}
+}
+
+// metricsMiddleware records every request against route, which should be
+// the registered mux pattern rather than the raw path so that ids don't
+// blow up the label cardinality.
+func metricsMiddleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		metrics.observe(route, r.Method, rec.status, time.Since(start))
+	})
+}
+
+func handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metrics.writeTo(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// migrationTimeout bounds a single migration, which may have to rewrite a
+// large table.
+const migrationTimeout = time.Minute
+
+// A migration is one step of the schema. up runs outside a transaction,
+// since MySQL commits implicitly around DDL anyway, so it must be safe to
+// run again if the process dies before the step is recorded.
+type migration struct {
+	version int
+	name    string
+	up      func(s *Server, ctx context.Context) error
+}
+
+// migrations are applied in order, each at most once. Append new steps to
+// the end and never edit or reorder one that has shipped.
+var migrations = []migration{
+	{1, "create books", (*Server).createBooksTable},
+	{2, "create idempotency_keys", (*Server).createIdempotencyTable},
+	{3, "create reviews", (*Server).createReviewsTable},
+	{4, "create covers", (*Server).createCoversTable},
+	{5, "add books fulltext index", (*Server).createBooksFullTextIndex},
+	{6, "create tags and book_tags", (*Server).createTagsTables},
+	{7, "add books version", addBooksColumn("version", "INT NOT NULL DEFAULT 1")},
+	{8, "add books created_at", addBooksTimestamp("created_at")},
+	{9, "add books updated_at", addBooksTimestamp("updated_at")},
+	{10, "add books isbn", (*Server).addBooksISBN},
+	{11, "add books deleted_at", addBooksColumn("deleted_at", "DATETIME NULL")},
+	{12, "add books year", addBooksColumn("year", "INT NULL")},
+	{13, "add books genre", addBooksColumn("genre", "VARCHAR(64) NULL")},
+	{14, "add books price_cents", addBooksColumn("price_cents", "BIGINT NULL")},
+}
+
+// autoIncrementID is the id column definition for the current driver.
+func (s *Server) autoIncrementID() string {
+	if s.driver == driverSQLite {
+		return "id INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+	return "id INT NOT NULL AUTO_INCREMENT PRIMARY KEY"
+}
+
+// createBooksTable creates the books table as it first shipped. Every
+// column added since has a step of its own further down the list, so a
+// database created by hand or by an older build is brought up to the same
+// schema as a new one.
+func (s *Server) createBooksTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS books (
+	`+s.autoIncrementID()+`,
+	title VARCHAR(255) NOT NULL,
+	author VARCHAR(255) NOT NULL
+	)`)
+	return err
+}
+
+// hasBooksColumn reports whether the books table has a column named name.
+func (s *Server) hasBooksColumn(ctx context.Context, name string) (bool, error) {
+	query := `SELECT COUNT(*) FROM information_schema.columns
+	WHERE table_schema = DATABASE() AND table_name = 'books' AND column_name = ?`
+	if s.driver == driverSQLite {
+		query = `SELECT COUNT(*) FROM pragma_table_info('books') WHERE name = ?`
+	}
+	var count int
+	err := s.db.QueryRowContext(ctx, query, name).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// addBooksColumn returns a migration adding the column name with the given
+// definition, unless books already has it.
+func addBooksColumn(name, definition string) func(s *Server, ctx context.Context) error {
+	return func(s *Server, ctx context.Context) error {
+		exists, err := s.hasBooksColumn(ctx, name)
+		if err != nil || exists {
+			return err
+		}
+		_, err = s.db.ExecContext(ctx, `ALTER TABLE books ADD COLUMN `+name+` `+definition)
+		return err
+	}
+}
+
+// unsetTimestamp fills a timestamp column added to rows that existed
+// before it. Neither driver can add a NOT NULL column without a default.
+const unsetTimestamp = "1970-01-01 00:00:00"
+
+// addBooksTimestamp returns a migration adding the NOT NULL DATETIME column
+// name. Rows that predate it get the time of the migration rather than 1970;
+// that UPDATE matches only unsetTimestamp, so running the step again after
+// a crash finishes the job without touching anything else.
+func addBooksTimestamp(name string) func(s *Server, ctx context.Context) error {
+	add := addBooksColumn(name, `DATETIME NOT NULL DEFAULT '`+unsetTimestamp+`'`)
+	return func(s *Server, ctx context.Context) error {
+		err := add(s, ctx)
+		if err != nil {
+			return err
+		}
+		_, err = s.db.ExecContext(ctx, `UPDATE books SET `+name+` = ? WHERE `+name+` = '`+unsetTimestamp+`'`,
+			time.Now().UTC())
+		return err
+	}
+}
+
+// addBooksISBN adds the isbn column and its unique index. The index is
+// created separately because SQLite can't add a UNIQUE column to an
+// existing table.
+func (s *Server) addBooksISBN(ctx context.Context) error {
+	err := addBooksColumn("isbn", "VARCHAR(13) NULL")(s, ctx)
+	if err != nil {
+		return err
+	}
+	exists, err := s.hasUniqueISBNIndex(ctx)
+	if err != nil || exists {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `CREATE UNIQUE INDEX books_isbn ON books (isbn)`)
+	return err
+}
+
+// hasUniqueISBNIndex reports whether a unique index covers books.isbn,
+// including the one a UNIQUE column definition creates implicitly.
+func (s *Server) hasUniqueISBNIndex(ctx context.Context) (bool, error) {
+	query := `SELECT COUNT(*) FROM information_schema.statistics
+	WHERE table_schema = DATABASE() AND table_name = 'books' AND column_name = 'isbn' AND non_unique = 0`
+	if s.driver == driverSQLite {
+		query = `SELECT COUNT(*) FROM pragma_index_list('books') il, pragma_index_info(il.name) ii
+		WHERE il."unique" = 1 AND ii.name = 'isbn'`
+	}
+	var count int
+	err := s.db.QueryRowContext(ctx, query).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// createBooksFullTextIndex adds the FULLTEXT index ?q= ranks with. SQLite
+// has no FULLTEXT indexes, so there it does nothing and search falls back to
+// substring matching.
+func (s *Server) createBooksFullTextIndex(ctx context.Context) error {
+	if s.driver == driverSQLite {
+		return nil
+	}
+	exists, err := s.hasFullTextIndex(ctx)
+	if err != nil || exists {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `CREATE FULLTEXT INDEX books_title_author_ft ON books (title, author)`)
+	return err
+}
+
+// migrate brings the schema up to date, recording each applied migration
+// in schema_migrations.
+func (s *Server) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INT NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		err := s.applyMigration(m)
+		if err != nil {
+			logger.Error("migration failed", "version", m.version, "name", m.name, "error", err)
+			return err
+		}
+		logger.Info("applied migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// appliedMigrations returns the set of versions already recorded.
+func (s *Server) appliedMigrations(ctx context.Context) (map[int]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		err := rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs m and records it.
+func (s *Server) applyMigration(m migration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+	err := m.up(s, ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, time.Now().UTC())
+	if isUniqueViolation(err) {
+		// another instance starting at the same time got there first
+		return nil
+	}
+	return err
+}
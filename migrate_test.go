@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// createLegacyBooks creates and fills a books table at dsn by hand, the way
+// some deployments set one up before migrations existed.
+func createLegacyBooks(t *testing.T, dsn, schema string, books ...string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range books {
+		_, err = db.Exec(`INSERT INTO books (title, author) VALUES (?, 'Author')`, title)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateFromBaseline(t *testing.T) {
+	dsn := sqliteDSN(t)
+	createLegacyBooks(t, dsn, `CREATE TABLE books (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title VARCHAR(255) NOT NULL,
+	author VARCHAR(255) NOT NULL
+	)`, "Dune", "Emma")
+	before := time.Now().Add(-time.Second)
+	s := openSQLiteServer(t, dsn)
+	ctx := context.Background()
+
+	book, err := s.getBook(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book == nil || book.Title != "Dune" {
+		t.Fatalf("getBook(1) = %+v, want Dune", book)
+	}
+	if book.Version != 1 {
+		t.Errorf("Version = %d, want 1", book.Version)
+	}
+	if book.CreatedAt.Before(before) || book.UpdatedAt.Before(before) {
+		t.Errorf("timestamps = %v, %v, want the time of the migration", book.CreatedAt, book.UpdatedAt)
+	}
+	if book.DeletedAt != nil || book.ISBN != "" || book.Year != 0 || book.Genre != "" || book.PriceCents != 0 {
+		t.Errorf("added columns of an existing row = %+v, want them unset", book)
+	}
+
+	_, err = s.insertBook(ctx, Book{Title: "Dune Messiah", Author: "Frank Herbert", ISBN: "9780441172696"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.insertBook(ctx, Book{Title: "Children of Dune", Author: "Frank Herbert", ISBN: "9780441172696"})
+	if err != errDuplicateISBN {
+		t.Errorf("inserting a duplicate ISBN: err = %v, want %v", err, errDuplicateISBN)
+	}
+}
+
+// TestMigrationsRerun runs every step again on an up-to-date schema, as
+// happens when the process dies between applying a step and recording it.
+func TestMigrationsRerun(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{"baseline", `CREATE TABLE books (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title VARCHAR(255) NOT NULL,
+		author VARCHAR(255) NOT NULL
+		)`},
+		{"created in one step", `CREATE TABLE books (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title VARCHAR(255) NOT NULL,
+		author VARCHAR(255) NOT NULL,
+		isbn VARCHAR(13) NULL UNIQUE,
+		year INT NULL,
+		genre VARCHAR(64) NULL,
+		price_cents BIGINT NULL,
+		version INT NOT NULL DEFAULT 1,
+		created_at DATETIME NOT NULL DEFAULT '2020-01-01 00:00:00',
+		updated_at DATETIME NOT NULL DEFAULT '2020-01-01 00:00:00',
+		deleted_at DATETIME NULL
+		)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn := sqliteDSN(t)
+			createLegacyBooks(t, dsn, tt.schema, "Dune")
+			s := openSQLiteServer(t, dsn)
+			ctx := context.Background()
+			for _, m := range migrations {
+				err := m.up(s, ctx)
+				if err != nil {
+					t.Fatalf("migration %d (%s) again: %v", m.version, m.name, err)
+				}
+			}
+			var indexes int
+			err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_index_list('books') il, pragma_index_info(il.name) ii
+			WHERE il."unique" = 1 AND ii.name = 'isbn'`).Scan(&indexes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if indexes != 1 {
+				t.Errorf("unique indexes on isbn = %d, want 1", indexes)
+			}
+			book, err := s.getBook(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book == nil || book.CreatedAt.Year() < 2020 {
+				t.Errorf("getBook(1) = %+v, want its timestamps kept", book)
+			}
+		})
+	}
+}
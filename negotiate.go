@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// bookListXML gives a []Book a root element when rendered as XML.
+type bookListXML struct {
+	XMLName xml.Name `xml:"books"`
+	Books   []Book   `xml:"book"`
+}
+
+// prefersXML reports whether the Accept header ranks application/xml (or
+// text/xml) above JSON. An absent header, */* or a tie all mean JSON.
+func prefersXML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	jsonQ, xmlQ := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/xml", "text/xml":
+			xmlQ = max(xmlQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return xmlQ > 0 && xmlQ > jsonQ
+}
+
+// marshalNegotiated encodes v as XML or JSON depending on the request's
+// Accept header and sets Content-Type to match. ?pretty=true indents
+// either.
+func marshalNegotiated(w http.ResponseWriter, r *http.Request, v interface{}) ([]byte, error) {
+	w.Header().Add("Vary", "Accept")
+	pretty := prettyJSON(r)
+	if !prefersXML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if pretty {
+			return json.MarshalIndent(v, "", "  ")
+		}
+		return json.Marshal(v)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	if books, ok := v.([]Book); ok {
+		v = bookListXML{Books: books}
+	}
+	var body []byte
+	var err error
+	if pretty {
+		body, err = xml.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = xml.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// writeNegotiated is writeJSON for responses that may also be XML.
+func writeNegotiated(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := marshalNegotiated(w, r, v)
+	if err != nil {
+		logCtx(r.Context(), err)
+		writeJSONError(w, http.StatusInternalServerError, "could not encode response")
+		return
+	}
+	w.WriteHeader(status)
+	_, err = w.Write(body)
+	if err != nil {
+		// the client has gone away; the status is already sent
+		logCtx(r.Context(), err)
+	}
+}
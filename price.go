@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Cents is an amount of money in hundredths of the currency unit. It is kept
+// as an integer so no arithmetic or round trip ever goes through a float, and
+// is written as a decimal string such as "12.99" in JSON and XML.
+type Cents int64
+
+var errInvalidPrice = errors.New(`must be a decimal string with at most two decimal places, such as "12.99"`)
+
+// parsePrice parses a decimal amount like "12.99", "12.9" or "12" into
+// cents. A leading minus sign is accepted here and rejected by validation.
+func parsePrice(s string) (Cents, error) {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" || len(frac) > 2 || (hasFrac && frac == "") || !isDigits(whole) || !isDigits(frac) {
+		return 0, errInvalidPrice
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, errInvalidPrice
+	}
+	cents := int64(0)
+	if frac != "" {
+		cents, _ = strconv.ParseInt(frac, 10, 64)
+		if len(frac) == 1 {
+			cents *= 10
+		}
+	}
+	if units > (1<<63-1)/100-1 {
+		return 0, errInvalidPrice
+	}
+	total := Cents(units*100 + cents)
+	if negative {
+		total = -total
+	}
+	return total, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Cents) String() string {
+	sign := ""
+	n := int64(c)
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, n/100, n%100)
+}
+
+func (c Cents) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Cents) UnmarshalText(text []byte) error {
+	parsed, err := parsePrice(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// nullablePrice returns price for storage, or nil when it is zero.
+func nullablePrice(price Cents) interface{} {
+	if price == 0 {
+		return nil
+	}
+	return int64(price)
+}
+
+// validatePrice rejects negative prices. Zero means no price is set.
+func validatePrice(errs fieldErrors, name string, price Cents) {
+	if price < 0 {
+		errs[name] = "must not be negative"
+	}
+}
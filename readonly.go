@@ -0,0 +1,21 @@
+package main
+
+import "net/http"
+
+// readOnly rejects every write, for serving a public mirror of the catalog.
+var readOnly bool
+
+// readOnlyMiddleware answers POST, PUT, PATCH and DELETE with 403 while
+// readOnly is set. Reads and preflights pass through.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnly {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+				writeJSONError(w, http.StatusForbidden, "read-only mode")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
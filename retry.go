@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// errPoolExhausted means a database call could not get a connection
+// because every one the pool may open was busy.
+var errPoolExhausted = errors.New("database connection pool exhausted")
+
+// dbRetryDelay is how long retryDB waits before its single retry, giving a
+// restarting database a moment to accept connections again.
+const dbRetryDelay = 200 * time.Millisecond
+
+// isTransientDBError reports whether err looks like a lost or refused
+// connection rather than a problem with the query itself. Cancellation and
+// deadlines are never transient: the caller has given up.
+func isTransientDBError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryDB runs fn and, if it fails with a transient error, runs it once more
+// after checking the pool can reach the database again. fn must be safe to
+// repeat. A slow call is logged under the name of retryDB's caller.
+func (s *Server) retryDB(ctx context.Context, fn func() error) error {
+	return s.runDB(ctx, callerName(1), fn)
+}
+
+// poolSaturated reports whether every connection the pool may open is in
+// use, so a new call would have to wait for one to come back. SQLite runs on
+// a single connection on purpose and its calls are meant to queue, so it is
+// never saturated.
+func (s *Server) poolSaturated() bool {
+	if s.driver == driverSQLite {
+		return false
+	}
+	stats := s.db.Stats()
+	return stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections
+}
+
+// runDB is retryDB with the name to log a slow call under. A call made
+// while the pool is saturated fails at once with errPoolExhausted instead
+// of queuing behind the others, as does one whose deadline passed while it
+// was still waiting for a connection.
+func (s *Server) runDB(ctx context.Context, name string, fn func() error) error {
+	defer logIfSlow(ctx, name, time.Now())
+	if s.poolSaturated() {
+		logger.WarnContext(ctx, "database pool saturated, failing fast", "query", name, "max_open", s.db.Stats().MaxOpenConnections)
+		return errPoolExhausted
+	}
+	err := fn()
+	if errors.Is(err, context.DeadlineExceeded) && s.poolSaturated() {
+		return fmt.Errorf("%w: %w", errPoolExhausted, err)
+	}
+	if !isTransientDBError(err) {
+		return err
+	}
+	logger.WarnContext(ctx, "transient database error, retrying once", "error", err)
+	select {
+	case <-time.After(dbRetryDelay):
+	case <-ctx.Done():
+		return err
+	}
+	// the pool drops broken connections, so a successful ping means a
+	// fresh one is available for the retry
+	if pingErr := s.db.PingContext(ctx); pingErr != nil {
+		logger.WarnContext(ctx, "database still unreachable", "error", pingErr)
+		return err
+	}
+	return fn()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Review is a reader's rating of a book, optionally with a comment.
+type Review struct {
+	ID        int       `json:"id"`
+	BookID    int       `json:"book_id"`
+	Rating    int       `json:"rating"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// The accepted range of Review.Rating.
+const (
+	minRating = 1
+	maxRating = 5
+)
+
+// maxCommentLength matches the VARCHAR(2000) comment column.
+const maxCommentLength = 2000
+
+const reviewColumns = "id, book_id, rating, comment, created_at"
+
+// createReviewsTable creates the reviews table if it doesn't exist yet.
+func (s *Server) createReviewsTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS reviews (
+	`+s.autoIncrementID()+`,
+	book_id INT NOT NULL,
+	rating INT NOT NULL,
+	comment VARCHAR(2000) NOT NULL,
+	created_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// validateReview checks the client-supplied fields of review.
+func validateReview(review Review) error {
+	errs := fieldErrors{}
+	if review.Rating < minRating || review.Rating > maxRating {
+		errs["rating"] = fmt.Sprintf("must be between %d and %d", minRating, maxRating)
+	}
+	if utf8.RuneCountInString(review.Comment) > maxCommentLength {
+		errs["comment"] = fmt.Sprintf("must be at most %d characters", maxCommentLength)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// bookRating aggregates the reviews of one book. AverageRating is nil when
+// the book has no reviews.
+type bookRating struct {
+	AverageRating *float64 `json:"average_rating" xml:"average_rating,omitempty"`
+	ReviewCount   int      `json:"review_count" xml:"review_count"`
+}
+
+// ratedBook is a book with its rating, the response to ?include=rating.
+type ratedBook struct {
+	*Book
+	bookRating
+}
+
+// parseIncludeRating reads ?include=. rating is the only value there is;
+// it is opt-in so a plain GET doesn't pay for the extra query.
+func parseIncludeRating(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("include")
+	if v == "" {
+		return false, nil
+	}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "rating" {
+			return false, fmt.Errorf("unknown value %q in include", name)
+		}
+	}
+	return true, nil
+}
+
+// getBookRating returns the average rating and review count of bookID.
+func (s *Server) getBookRating(ctx context.Context, bookID int) (bookRating, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var rating bookRating
+	var average sql.NullFloat64
+	err := s.retryDB(ctx, func() error {
+		return s.db.QueryRowContext(ctx, `SELECT AVG(rating), COUNT(*) FROM reviews WHERE book_id = ?`, bookID).
+			Scan(&average, &rating.ReviewCount)
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return bookRating{}, err
+	}
+	if average.Valid {
+		rating.AverageRating = &average.Float64
+	}
+	return rating, nil
+}
+
+// getReviews returns a page of the reviews of bookID, oldest first. It
+// returns errBookNotFound if the book doesn't exist or has been deleted.
+func (s *Server) getReviews(ctx context.Context, bookID, limit, offset int) ([]Review, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	exists, err := s.bookExists(ctx, bookID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errBookNotFound
+	}
+	var reviews []Review
+	err = s.retryDB(ctx, func() error {
+		rows, err := s.db.QueryContext(ctx, `SELECT `+reviewColumns+` FROM reviews WHERE book_id = ? ORDER BY created_at, id LIMIT ? OFFSET ?`,
+			bookID, limit, offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		reviews = make([]Review, 0)
+		for rows.Next() {
+			var review Review
+			err := rows.Scan(&review.ID, &review.BookID, &review.Rating, &review.Comment, &review.CreatedAt)
+			if err != nil {
+				return err
+			}
+			reviews = append(reviews, review)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		logCtx(ctx, err)
+	}
+	return reviews, err
+}
+
+// insertReview stores review against its book and returns it with the id
+// and created_at filled in. It returns errBookNotFound if the book doesn't
+// exist or has been deleted.
+func (s *Server) insertReview(ctx context.Context, review Review) (Review, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	review.CreatedAt = time.Now().UTC()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		live, err := bookIsLive(ctx, tx, review.BookID)
+		if err != nil {
+			return err
+		}
+		if !live {
+			return errBookNotFound
+		}
+		result, err := tx.ExecContext(ctx, `INSERT INTO reviews (book_id, rating, comment, created_at) VALUES (?, ?, ?, ?)`,
+			review.BookID, review.Rating, review.Comment, review.CreatedAt)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		review.ID = int(id)
+		return err
+	})
+	if err != nil {
+		if err != errBookNotFound {
+			logCtx(ctx, err)
+		}
+		return Review{}, err
+	}
+	return review, nil
+}
+
+// handlerBookReviews lists (GET) or adds (POST) the reviews of a book.
+func (s *Server) handlerBookReviews(w http.ResponseWriter, r *http.Request, bookID int) {
+	switch r.Method {
+	case http.MethodGet:
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		reviews, err := s.getReviews(r.Context(), bookID, limit, offset)
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		} else if err != nil {
+			writeDBError(w, err, "could not list reviews")
+			return
+		}
+		writeJSON(w, http.StatusOK, reviews, prettyJSON(r))
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		var input struct {
+			Rating  int    `json:"rating"`
+			Comment string `json:"comment"`
+		}
+		err := newStrictDecoder(r.Body).Decode(&input)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+		review := Review{BookID: bookID, Rating: input.Rating, Comment: input.Comment}
+		err = validateReview(review)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		review, err = s.insertReview(r.Context(), review)
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		} else if err != nil {
+			writeDBError(w, err, "could not create review")
+			return
+		}
+		writeJSON(w, http.StatusCreated, review, prettyJSON(r))
+	case http.MethodOptions:
+		writePreflight(w, "GET, POST, OPTIONS")
+	default:
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "context"
+
+// sampleBooks is the demo catalog -seed loads.
+var sampleBooks = []Book{
+	{Title: "The Go Programming Language", Author: "Alan A. A. Donovan", ISBN: "9780134190440", Year: 2015, Genre: "programming", PriceCents: 3999},
+	{Title: "The Pragmatic Programmer", Author: "David Thomas", ISBN: "9780135957059", Year: 2019, Genre: "programming", PriceCents: 4499},
+	{Title: "Structure and Interpretation of Computer Programs", Author: "Harold Abelson", ISBN: "9780262510875", Year: 1996, Genre: "programming", PriceCents: 5500},
+	{Title: "Dune", Author: "Frank Herbert", ISBN: "9780441172719", Year: 1965, Genre: "science fiction", PriceCents: 1099},
+	{Title: "The Hobbit", Author: "J. R. R. Tolkien", ISBN: "9780547928227", Year: 1937, Genre: "fantasy", PriceCents: 1499},
+	{Title: "Pride and Prejudice", Author: "Jane Austen", ISBN: "9780141439518", Year: 1813, Genre: "classics", PriceCents: 799},
+}
+
+// seedBooks inserts sampleBooks into an empty catalog. It does nothing if
+// there are any books at all, deleted ones included, so running it twice
+// is harmless.
+func (s *Server) seedBooks() error {
+	ctx := context.Background()
+	count, err := s.countBooks(ctx, bookFilter{IncludeDeleted: true})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		logger.Info("catalog is not empty, not seeding", "books", count)
+		return nil
+	}
+	_, err = s.insertBooks(ctx, sampleBooks)
+	if err != nil {
+		return err
+	}
+	logger.Info("seeded sample books", "books", len(sampleBooks))
+	return nil
+}
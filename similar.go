@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// defaultSimilarLimit and maxSimilarLimit bound the ?limit= of
+// /books/{id}/similar.
+const (
+	defaultSimilarLimit = 5
+	maxSimilarLimit     = 20
+)
+
+// similarBooks returns up to limit other current books by book's author or,
+// if it has one, in its genre. Books by the same author come first.
+func (s *Server) similarBooks(ctx context.Context, book *Book, limit int) ([]Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	match := `author = ?`
+	args := []interface{}{book.Author}
+	if book.Genre != "" {
+		match = `(author = ? OR genre = ?)`
+		args = append(args, book.Genre)
+	}
+	args = append(args, int(book.ID), book.Author, limit)
+	var books []Book
+	err := s.retryDB(ctx, func() error {
+		var err error
+		books, err = s.queryBooks(ctx, `SELECT `+bookColumns+` FROM books WHERE `+match+` AND id != ? AND deleted_at IS NULL
+		ORDER BY CASE WHEN author = ? THEN 0 ELSE 1 END, id LIMIT ?`, args...)
+		return err
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return books, nil
+}
+
+// handlerSimilarBooks recommends books like bookID for a "you might also
+// like" list.
+func (s *Server) handlerSimilarBooks(w http.ResponseWriter, r *http.Request, bookID int) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	limit := defaultSimilarLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSimilarLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be an integer between 1 and %d", maxSimilarLimit))
+			return
+		}
+		limit = n
+	}
+	book, err := s.getBook(r.Context(), bookID)
+	if err != nil {
+		writeDBError(w, err, "could not fetch book")
+		return
+	}
+	if book == nil {
+		writeJSONError(w, http.StatusNotFound, "book not found")
+		return
+	}
+	books, err := s.similarBooks(r.Context(), book, limit)
+	if err != nil {
+		writeDBError(w, err, "could not find similar books")
+		return
+	}
+	writeNegotiated(w, r, http.StatusOK, books)
+}
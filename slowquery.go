@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// slowQueryThreshold is how long a database call may take before it is
+// logged as slow. It can be changed with SLOW_QUERY_THRESHOLD; 0 disables
+// the log.
+var slowQueryThreshold = 500 * time.Millisecond
+
+// callerName returns the name of the function skip frames up the stack,
+// without its package or receiver, such as "getBookList".
+func callerName(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	name := runtime.FuncForPC(pc).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// logIfSlow warns about the database call name when it has run longer
+// than slowQueryThreshold since start.
+func logIfSlow(ctx context.Context, name string, start time.Time) {
+	elapsed := time.Since(start)
+	if slowQueryThreshold > 0 && elapsed > slowQueryThreshold {
+		logger.WarnContext(ctx, "slow query", "query", name, "duration_ms", float64(elapsed.Microseconds())/1000,
+			"threshold_ms", slowQueryThreshold.Milliseconds())
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// getBookSQL is the statement behind s.stmts.getBook.
+const getBookSQL = `SELECT ` + bookColumns + ` FROM books WHERE id = ? AND deleted_at IS NULL`
+
+// insertBookSQL is the statement behind execInsertBook.
+const insertBookSQL = `INSERT INTO books
+	(title,
+	author,
+	isbn,
+	year,
+	genre,
+	price_cents,
+	version,
+	created_at,
+	updated_at
+	)VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?)`
+
+// statements are the hot queries, prepared once by prepareStatements. A
+// *sql.Stmt is safe for concurrent use and database/sql re-prepares it by
+// itself on any pooled connection that doesn't have it yet, including ones
+// opened to replace a recycled or broken connection.
+type statements struct {
+	getBook        *sql.Stmt // a book that hasn't been soft-deleted
+	getBookDeleted *sql.Stmt // a book whether or not it was soft-deleted
+	insertBook     *sql.Stmt
+}
+
+// prepareStatements prepares s.stmts on the server's database.
+func (s *Server) prepareStatements() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	var err error
+	s.stmts.getBook, err = s.db.PrepareContext(ctx, getBookSQL)
+	if err != nil {
+		return err
+	}
+	s.stmts.getBookDeleted, err = s.db.PrepareContext(ctx, `SELECT `+bookColumns+` FROM books WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	s.stmts.insertBook, err = s.db.PrepareContext(ctx, insertBookSQL)
+	return err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// BenchmarkGetBook compares reading one book through the prepared
+// statement with sending the same query text on every call.
+func BenchmarkGetBook(b *testing.B) {
+	s := newSQLiteServer(b)
+	ctx := context.Background()
+	id, err := s.insertBook(ctx, Book{Title: "Dune", Author: "Frank Herbert", ISBN: "9780441013593", Year: 1965})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var book Book
+			err := scanBook(s.stmts.getBook.QueryRowContext(ctx, id), &book)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unprepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var book Book
+			err := scanBook(s.db.QueryRowContext(ctx, getBookSQL, id), &book)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
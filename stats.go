@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statsCacheTTL is how long handlerStats reuses its last result, so a
+// dashboard polling it doesn't rerun the aggregates on every request.
+const statsCacheTTL = 5 * time.Second
+
+// authorCount is an author and how many current books they have.
+type authorCount struct {
+	Author string `json:"author"`
+	Books  int    `json:"books"`
+}
+
+// bookStats aggregates the books that haven't been soft-deleted. TopAuthor
+// is nil when there are none.
+type bookStats struct {
+	TotalBooks      int          `json:"total_books"`
+	DistinctAuthors int          `json:"distinct_authors"`
+	TopAuthor       *authorCount `json:"top_author"`
+}
+
+// statsCache holds the last bookStats until expires. The zero value is
+// empty and ready to use.
+type statsCache struct {
+	mu      sync.Mutex
+	stats   bookStats
+	expires time.Time
+}
+
+// getBookStats runs the aggregate queries. Ties for the top author go to
+// the alphabetically first.
+func (s *Server) getBookStats(ctx context.Context) (bookStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var stats bookStats
+	err := s.retryDB(ctx, func() error {
+		stats = bookStats{}
+		err := s.db.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(DISTINCT author) FROM books WHERE deleted_at IS NULL`).
+			Scan(&stats.TotalBooks, &stats.DistinctAuthors)
+		if err != nil {
+			return err
+		}
+		var top authorCount
+		err = s.db.QueryRowContext(ctx, `SELECT author, COUNT(*) FROM books WHERE deleted_at IS NULL
+		GROUP BY author ORDER BY COUNT(*) DESC, author ASC LIMIT 1`).Scan(&top.Author, &top.Books)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		stats.TopAuthor = &top
+		return nil
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return bookStats{}, err
+	}
+	return stats, nil
+}
+
+// cachedBookStats returns the cached stats, refreshing them once they are
+// older than statsCacheTTL. Requests that arrive during a refresh wait for
+// it instead of running the queries again.
+func (s *Server) cachedBookStats(ctx context.Context) (bookStats, error) {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if time.Now().Before(s.stats.expires) {
+		return s.stats.stats, nil
+	}
+	stats, err := s.getBookStats(ctx)
+	if err != nil {
+		return bookStats{}, err
+	}
+	s.stats.stats = stats
+	s.stats.expires = time.Now().Add(statsCacheTTL)
+	return stats, nil
+}
+
+// handlerStats returns aggregate counts over the catalog, at most
+// statsCacheTTL old.
+func (s *Server) handlerStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	stats, err := s.cachedBookStats(r.Context())
+	if err != nil {
+		writeDBError(w, err, "could not compute stats")
+		return
+	}
+	writeJSON(w, http.StatusOK, stats, prettyJSON(r))
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const tagsPath = "tags"
+
+// maxTagLength matches the VARCHAR(64) name column.
+const maxTagLength = 64
+
+// errTagNotFound means the book doesn't carry the tag being removed.
+var errTagNotFound = errors.New("tag not found")
+
+// createTagsTables creates tags, which holds each label once, and the
+// book_tags table joining them to books.
+func (s *Server) createTagsTables(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS tags (
+	`+s.autoIncrementID()+`,
+	name VARCHAR(64) NOT NULL UNIQUE
+	)`)
+	if err != nil {
+		return err
+	}
+	// the primary key serves a book's tags; ?tag= needs the other way round
+	if s.driver == driverSQLite {
+		_, err = s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS book_tags (
+		book_id INT NOT NULL,
+		tag_id INT NOT NULL,
+		PRIMARY KEY (book_id, tag_id)
+		)`)
+		if err != nil {
+			return err
+		}
+		_, err = s.db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS book_tags_tag_id ON book_tags (tag_id)`)
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS book_tags (
+	book_id INT NOT NULL,
+	tag_id INT NOT NULL,
+	PRIMARY KEY (book_id, tag_id),
+	KEY book_tags_tag_id (tag_id)
+	)`)
+	return err
+}
+
+// normalizeTag trims tag and lower-cases it, so "Sci-Fi " and "sci-fi" are
+// the same tag.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// validateTag checks a tag already passed through normalizeTag. A slash is
+// refused because the tag has to fit in one segment of its DELETE path.
+func validateTag(tag string) error {
+	switch {
+	case tag == "":
+		return fieldErrors{"tag": "must not be empty"}
+	case utf8.RuneCountInString(tag) > maxTagLength:
+		return fieldErrors{"tag": fmt.Sprintf("must be at most %d characters", maxTagLength)}
+	case strings.Contains(tag, "/"):
+		return fieldErrors{"tag": "must not contain /"}
+	}
+	return nil
+}
+
+// normalizeTags normalizes and validates tags as given in a book body,
+// dropping repeats.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		var errs fieldErrors
+		if errors.As(validateTag(tag), &errs) {
+			return nil, fieldErrors{"tags": errs["tag"]}
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// tagsOfBooks returns the tags of each of bookIDs that has any, in name
+// order, with one query.
+func (s *Server) tagsOfBooks(ctx context.Context, bookIDs []int) (map[int][]string, error) {
+	tags := make(map[int][]string)
+	if len(bookIDs) == 0 {
+		return tags, nil
+	}
+	args := make([]interface{}, 0, len(bookIDs))
+	for _, id := range bookIDs {
+		args = append(args, id)
+	}
+	err := s.retryDB(ctx, func() error {
+		clear(tags)
+		rows, err := s.db.QueryContext(ctx, `SELECT bt.book_id, t.name FROM book_tags bt JOIN tags t ON t.id = bt.tag_id
+			WHERE bt.book_id IN (`+placeholders(len(bookIDs))+`) ORDER BY bt.book_id, t.name`, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var tag string
+			err := rows.Scan(&id, &tag)
+			if err != nil {
+				return err
+			}
+			tags[id] = append(tags[id], tag)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return tags, nil
+}
+
+// bookTags returns the tags of bookID in name order.
+func (s *Server) bookTags(ctx context.Context, bookID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var tags []string
+	err := s.retryDB(ctx, func() error {
+		rows, err := s.db.QueryContext(ctx, `SELECT t.name FROM book_tags bt JOIN tags t ON t.id = bt.tag_id
+			WHERE bt.book_id = ? ORDER BY t.name`, bookID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		tags = make([]string, 0)
+		for rows.Next() {
+			var tag string
+			err := rows.Scan(&tag)
+			if err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		logCtx(ctx, err)
+		return nil, err
+	}
+	return tags, nil
+}
+
+// tagID returns the id of the tag named name, creating the tag if it is
+// new.
+func tagID(ctx context.Context, tx *sql.Tx, name string) (int, error) {
+	var id int
+	err := tx.QueryRowContext(ctx, `SELECT id FROM tags WHERE name = ?`, name).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	result, err := tx.ExecContext(ctx, `INSERT INTO tags (name) VALUES (?)`, name)
+	if isUniqueViolation(err) {
+		// created by a concurrent request since the SELECT
+		err = tx.QueryRowContext(ctx, `SELECT id FROM tags WHERE name = ?`, name).Scan(&id)
+		return id, err
+	} else if err != nil {
+		return 0, err
+	}
+	insertID, err := result.LastInsertId()
+	return int(insertID), err
+}
+
+// bumpBookVersion records a change to bookID made outside its own columns,
+// such as its tags, which are part of its ETag. Without the new version a
+// PUT pinned by If-Match to the old one could still land.
+func bumpBookVersion(ctx context.Context, tx *sql.Tx, bookID int) error {
+	_, err := tx.ExecContext(ctx, `UPDATE books SET version = version + 1, updated_at = ? WHERE id = ?`,
+		time.Now().UTC(), bookID)
+	return err
+}
+
+// insertBookTags tags the new book bookID with tags, which must already be
+// normalized and free of repeats, as part of tx.
+func insertBookTags(ctx context.Context, tx *sql.Tx, bookID int, tags []string) error {
+	for _, tag := range tags {
+		id, err := tagID(ctx, tx, tag)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO book_tags (book_id, tag_id) VALUES (?, ?)`, bookID, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBookTag tags bookID with tag, which must already be normalized. It
+// reports whether the book didn't have the tag yet, and returns
+// errBookNotFound if the book doesn't exist or has been deleted. A new tag
+// bumps the book's version.
+func (s *Server) addBookTag(ctx context.Context, bookID int, tag string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var added bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		added = false
+		live, err := bookIsLive(ctx, tx, bookID)
+		if err != nil {
+			return err
+		}
+		if !live {
+			return errBookNotFound
+		}
+		id, err := tagID(ctx, tx, tag)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO book_tags (book_id, tag_id) VALUES (?, ?)`, bookID, id)
+		if isUniqueViolation(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		added = true
+		return bumpBookVersion(ctx, tx, bookID)
+	})
+	if err != nil {
+		if err != errBookNotFound {
+			logCtx(ctx, err)
+		}
+		return false, err
+	}
+	return added, nil
+}
+
+// removeBookTag takes tag off bookID. It returns errBookNotFound if the
+// book doesn't exist or has been deleted and errTagNotFound if it doesn't
+// have the tag. The tag itself is kept for other books to use, and the
+// book's version is bumped.
+func (s *Server) removeBookTag(ctx context.Context, bookID int, tag string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		live, err := bookIsLive(ctx, tx, bookID)
+		if err != nil {
+			return err
+		}
+		if !live {
+			return errBookNotFound
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM book_tags WHERE book_id = ? AND tag_id IN (SELECT id FROM tags WHERE name = ?)`,
+			bookID, tag)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errTagNotFound
+		}
+		return bumpBookVersion(ctx, tx, bookID)
+	})
+	if err != nil && err != errBookNotFound && err != errTagNotFound {
+		logCtx(ctx, err)
+	}
+	return err
+}
+
+// handlerBookTags lists (GET) or adds to (POST) the tags of a book. Adding
+// a tag the book already has changes nothing and answers 200 instead of
+// 201; both respond with the book's tags.
+func (s *Server) handlerBookTags(w http.ResponseWriter, r *http.Request, bookID int) {
+	switch r.Method {
+	case http.MethodGet:
+		exists, err := s.bookExists(r.Context(), bookID)
+		if err != nil {
+			writeDBError(w, err, "could not list tags")
+			return
+		}
+		if !exists {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		}
+		tags, err := s.bookTags(r.Context(), bookID)
+		if err != nil {
+			writeDBError(w, err, "could not list tags")
+			return
+		}
+		writeJSON(w, http.StatusOK, tags, prettyJSON(r))
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		var input struct {
+			Tag string `json:"tag"`
+		}
+		err := newStrictDecoder(r.Body).Decode(&input)
+		if err != nil {
+			logCtx(r.Context(), err)
+			writeDecodeError(w, err)
+			return
+		}
+		tag := normalizeTag(input.Tag)
+		err = validateTag(tag)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		added, err := s.addBookTag(r.Context(), bookID, tag)
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		} else if err != nil {
+			writeDBError(w, err, "could not add tag")
+			return
+		}
+		status := http.StatusOK
+		if added {
+			s.booksChanged(eventUpdated, bookID)
+			status = http.StatusCreated
+		}
+		tags, err := s.bookTags(r.Context(), bookID)
+		if err != nil {
+			writeDBError(w, err, "could not list tags")
+			return
+		}
+		writeJSON(w, status, tags, prettyJSON(r))
+	case http.MethodOptions:
+		writePreflight(w, "GET, POST, OPTIONS")
+	default:
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
+	}
+}
+
+// handlerBookTag removes one tag from a book at books/{id}/tags/{tag}.
+func (s *Server) handlerBookTag(w http.ResponseWriter, r *http.Request, bookID int, tag string) {
+	switch r.Method {
+	case http.MethodDelete:
+		err := s.removeBookTag(r.Context(), bookID, normalizeTag(tag))
+		if err == errBookNotFound {
+			writeJSONError(w, http.StatusNotFound, "book not found")
+			return
+		} else if err == errTagNotFound {
+			writeJSONError(w, http.StatusNotFound, "book has no such tag")
+			return
+		} else if err != nil {
+			writeDBError(w, err, "could not remove tag")
+			return
+		}
+		s.booksChanged(eventUpdated, bookID)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodOptions:
+		writePreflight(w, "DELETE, OPTIONS")
+	default:
+		writeMethodNotAllowed(w, "DELETE, OPTIONS")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTagChangesBumpVersion(t *testing.T) {
+	s := newSQLiteServer(t)
+	ctx := context.Background()
+	id, err := s.insertBook(ctx, Book{Title: "Dune", Author: "Frank Herbert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name    string
+		change  func() error
+		err     error
+		version int
+	}{
+		{"add", func() error { _, err := s.addBookTag(ctx, id, "classic"); return err }, nil, 2},
+		{"add again", func() error { _, err := s.addBookTag(ctx, id, "classic"); return err }, nil, 2},
+		{"remove", func() error { return s.removeBookTag(ctx, id, "classic") }, nil, 3},
+		{"remove missing", func() error { return s.removeBookTag(ctx, id, "classic") }, errTagNotFound, 3},
+	}
+	for _, step := range steps {
+		err := step.change()
+		if err != step.err {
+			t.Fatalf("%s: err = %v, want %v", step.name, err, step.err)
+		}
+		book, err := s.getBook(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if book.Version != step.version {
+			t.Errorf("after %s: Version = %d, want %d", step.name, book.Version, step.version)
+		}
+	}
+
+	// a PUT whose If-Match check passed before a tag change must not land
+	_, err = s.addBookTag(ctx, id, "sci-fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.updateBook(ctx, Book{ID: BookID(id), Title: "Dune", Author: "Frank Herbert", Version: 3})
+	if err != errVersionConflict {
+		t.Errorf("updateBook at the pre-tag version: err = %v, want %v", err, errVersionConflict)
+	}
+}
+
+// tagServer returns the routes of a SQLite server holding Dune as book 1
+// and Emma as book 2.
+func tagServer(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	s := newSQLiteServer(t)
+	_, err := s.insertBooks(context.Background(), []Book{
+		{Title: "Dune", Author: "Frank Herbert"},
+		{Title: "Emma", Author: "Jane Austen"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, s.SetupRoutes(http.NewServeMux())
+}
+
+// decodeTags returns the JSON array of tags in w's body.
+func decodeTags(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var tags []string
+	if err := json.Unmarshal(w.Body.Bytes(), &tags); err != nil {
+		t.Fatalf("body %q is not a list of tags: %v", w.Body, err)
+	}
+	return tags
+}
+
+func TestAddBookTag(t *testing.T) {
+	_, h := tagServer(t)
+	steps := []struct {
+		name    string
+		target  string
+		body    string
+		status  int
+		tags    string
+		message string
+	}{
+		{"new", "/api/books/1/tags", `{"tag": "sci-fi"}`, http.StatusCreated, "[sci-fi]", ""},
+		{"normalized", "/api/books/1/tags", `{"tag": "  Classic "}`, http.StatusCreated, "[classic sci-fi]", ""},
+		{"duplicate", "/api/books/1/tags", `{"tag": "SCI-FI"}`, http.StatusOK, "[classic sci-fi]", ""},
+		{"empty", "/api/books/1/tags", `{"tag": "  "}`, http.StatusUnprocessableEntity, "", "validation failed"},
+		{"slash", "/api/books/1/tags", `{"tag": "a/b"}`, http.StatusUnprocessableEntity, "", "validation failed"},
+		{"too long", "/api/books/1/tags", `{"tag": "` + strings.Repeat("x", maxTagLength+1) + `"}`, http.StatusUnprocessableEntity, "", "validation failed"},
+		{"missing book", "/api/books/9/tags", `{"tag": "sci-fi"}`, http.StatusNotFound, "", "book not found"},
+	}
+	for _, step := range steps {
+		w := serve(h, http.MethodPost, step.target, step.body)
+		if w.Code != step.status {
+			t.Fatalf("%s: status = %d, want %d; body %s", step.name, w.Code, step.status, w.Body)
+		}
+		if step.message != "" {
+			if got := errorMessage(t, w); got != step.message {
+				t.Errorf("%s: error = %q, want %q", step.name, got, step.message)
+			}
+			continue
+		}
+		if got := fmt.Sprint(decodeTags(t, w)); got != step.tags {
+			t.Errorf("%s: tags = %s, want %s", step.name, got, step.tags)
+		}
+	}
+}
+
+func TestRemoveBookTag(t *testing.T) {
+	s, h := tagServer(t)
+	_, err := s.addBookTag(context.Background(), 1, "sci-fi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name    string
+		target  string
+		status  int
+		message string
+	}{
+		{"present, any case", "/api/books/1/tags/Sci-Fi", http.StatusNoContent, ""},
+		{"already removed", "/api/books/1/tags/sci-fi", http.StatusNotFound, "book has no such tag"},
+		{"on another book", "/api/books/2/tags/sci-fi", http.StatusNotFound, "book has no such tag"},
+		{"missing book", "/api/books/9/tags/sci-fi", http.StatusNotFound, "book not found"},
+	}
+	for _, step := range steps {
+		w := serve(h, http.MethodDelete, step.target, "")
+		if w.Code != step.status {
+			t.Fatalf("%s: status = %d, want %d; body %s", step.name, w.Code, step.status, w.Body)
+		}
+		if step.message != "" {
+			if got := errorMessage(t, w); got != step.message {
+				t.Errorf("%s: error = %q, want %q", step.name, got, step.message)
+			}
+		}
+	}
+	w := serve(h, http.MethodGet, "/api/books/1/tags", "")
+	if got := decodeTags(t, w); len(got) != 0 {
+		t.Errorf("tags after removal = %v, want none", got)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	s, h := tagServer(t)
+	ctx := context.Background()
+	for _, bt := range []struct {
+		id  int
+		tag string
+	}{{1, "classic"}, {2, "classic"}, {1, "sci-fi"}} {
+		_, err := s.addBookTag(ctx, bt.id, bt.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		tag    string
+		titles string
+	}{
+		{"classic", "[Dune Emma]"},
+		{"Sci-Fi", "[Dune]"},
+		{"romance", "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			w := serve(h, http.MethodGet, "/api/books?tag="+tt.tag+"&sort=title", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body)
+			}
+			var books []Book
+			if err := json.Unmarshal(w.Body.Bytes(), &books); err != nil {
+				t.Fatal(err)
+			}
+			titles := make([]string, 0, len(books))
+			for _, book := range books {
+				titles = append(titles, book.Title)
+			}
+			if got := fmt.Sprint(titles); got != tt.titles {
+				t.Errorf("titles = %s, want %s", got, tt.titles)
+			}
+		})
+	}
+}
+
+func TestTagsInGetBook(t *testing.T) {
+	_, h := tagServer(t)
+	get := func() (Book, string) {
+		w := serve(h, http.MethodGet, "/api/books/1", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET status = %d; body %s", w.Code, w.Body)
+		}
+		var book Book
+		if err := json.Unmarshal(w.Body.Bytes(), &book); err != nil {
+			t.Fatal(err)
+		}
+		return book, w.Header().Get("ETag")
+	}
+	untagged, before := get()
+	if untagged.Tags != nil {
+		t.Errorf("untagged book has tags %v", untagged.Tags)
+	}
+	serve(h, http.MethodPost, "/api/books/1/tags", `{"tag": "sci-fi"}`)
+	tagged, after := get()
+	if fmt.Sprint(tagged.Tags) != "[sci-fi]" {
+		t.Errorf("tags = %v, want [sci-fi]", tagged.Tags)
+	}
+	if after == before {
+		t.Error("ETag unchanged by adding a tag")
+	}
+	serve(h, http.MethodDelete, "/api/books/1/tags/sci-fi", "")
+	if _, removed := get(); removed == after || removed == before {
+		t.Errorf("ETag after removing the tag = %s, want one differing from %s and %s", removed, before, after)
+	}
+}